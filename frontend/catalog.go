@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// catalogEntry is what the server knows about an image, see /catalog/.
+type catalogEntry struct {
+	Name          string        `json:"name"`
+	Versions      []string      `json:"versions"`
+	Ports         []catalogPort `json:"ports"`
+	MountPoints   []string      `json:"mountPoints"`
+	RequiredFlags []struct {
+		Name string `json:"name"`
+		Flag string `json:"flag"`
+		Type string `json:"type"`
+	} `json:"requiredFlags"`
+	Sources []string `json:"sources"`
+}
+
+type catalogPort struct {
+	Name     string `json:"name"`
+	Port     uint   `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+func loadCatalog() ([]catalogEntry, error) {
+	resp, err := http.Get("/catalog/")
+	if err != nil {
+		return nil, fmt.Errorf("unable to contact server: %v", err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read catalog: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to load catalog: %s", data)
+	}
+	var entries []catalogEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("unable to parse catalog: %v", err)
+	}
+	return entries, nil
+}
+
+// matches returns true if every word in query appears somewhere in e.
+func (e *catalogEntry) matches(query string) bool {
+	text := []string{e.Name}
+	text = append(text, e.Versions...)
+	text = append(text, e.MountPoints...)
+	for _, port := range e.Ports {
+		text = append(text, port.Name)
+	}
+	for _, rf := range e.RequiredFlags {
+		text = append(text, rf.Flag)
+	}
+	all := strings.ToLower(strings.Join(text, " "))
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+		if !strings.Contains(all, word) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *catalogEntry) summary() string {
+	var parts []string
+	for _, port := range e.Ports {
+		parts = append(parts, fmt.Sprintf("%s:%d", port.Name, port.Port))
+	}
+	for _, mp := range e.MountPoints {
+		parts = append(parts, "mount "+mp)
+	}
+	for _, rf := range e.RequiredFlags {
+		parts = append(parts, "--"+rf.Flag)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// setupPalette fills in the image palette from the server's catalog.  Images
+// can be dragged from the palette onto the canvas, and clicking one puts its
+// name in the container-name field.
+func setupPalette(w *Workspace, containerName *js.Object) {
+	doc := js.Global.Get("document")
+	search := doc.Call("getElementById", "catalog-search")
+	list := doc.Call("getElementById", "catalog")
+
+	var entries []catalogEntry
+	render := func() {
+		list.Set("innerHTML", "")
+		query := search.Get("value").String()
+		for i := range entries {
+			e := &entries[i]
+			if !e.matches(query) {
+				continue
+			}
+			item := doc.Call("createElement", "li")
+			item.Set("className", "pure-menu-item")
+			item.Set("title", fmt.Sprintf("From %s", strings.Join(e.Sources, ", ")))
+			item.Call("appendChild", paletteImage(doc, containerName, e.Name, e.Name))
+			for _, version := range e.Versions {
+				item.Call("appendChild", doc.Call("createTextNode", " "))
+				item.Call("appendChild", paletteImage(doc, containerName, version, e.Name+":"+version))
+			}
+			if summary := e.summary(); summary != "" {
+				item.Call("appendChild", doc.Call("createTextNode", " ("+summary+")"))
+			}
+			list.Call("appendChild", item)
+		}
+	}
+	refresh := func() {
+		go func() {
+			es, err := loadCatalog()
+			if err != nil {
+				SetToast("toaster", ToastError, err.Error())
+				return
+			}
+			entries = es
+			render()
+		}()
+	}
+	search.Call("addEventListener", "input", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		render()
+		return nil
+	}), false)
+	search.Call("addEventListener", "focus", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		refresh()
+		return nil
+	}), false)
+	refresh()
+
+	w.canvas.Call("addEventListener", "dragover", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		args[0].Call("preventDefault")
+		return nil
+	}), false)
+	w.canvas.Call("addEventListener", "drop", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		args[0].Call("preventDefault")
+		name := args[0].Get("dataTransfer").Call("getData", "text/plain").String()
+		if name == "" {
+			return nil
+		}
+		x, y, _, _, _ := w.getEventPosition(args[0])
+		go addImage(w, name, &point{x, y})
+		return nil
+	}), false)
+}
+
+// paletteImage makes a draggable label for the image called name.
+func paletteImage(doc, containerName *js.Object, text, name string) *js.Object {
+	span := doc.Call("createElement", "span")
+	span.Set("textContent", text)
+	span.Set("draggable", true)
+	span.Get("style").Set("cursor", "move")
+	span.Get("style").Set("textDecoration", "underline")
+	span.Call("addEventListener", "dragstart", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		args[0].Get("dataTransfer").Call("setData", "text/plain", name)
+		return nil
+	}), false)
+	span.Call("addEventListener", "click", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		containerName.Set("value", name)
+		return nil
+	}), false)
+	return span
+}
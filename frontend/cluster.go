@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// clusterTarget is a cluster that the server can deploy to, see /clusters/.
+type clusterTarget struct {
+	Name    string `json:"name"`
+	Context string `json:"context"`
+
+	// Namespace is what's used when the workspace doesn't set one.
+	Namespace string `json:"namespace"`
+}
+
+func loadClusters() ([]clusterTarget, error) {
+	resp, err := http.Get("/clusters/")
+	if err != nil {
+		return nil, fmt.Errorf("unable to contact server: %v", err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read clusters: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to load clusters: %s", data)
+	}
+	var clusters []clusterTarget
+	if err := json.Unmarshal(data, &clusters); err != nil {
+		return nil, fmt.Errorf("unable to parse clusters: %v", err)
+	}
+	return clusters, nil
+}
+
+// setupClusters fills in the cluster selector and tells the workspace which
+// cluster to use whenever it changes.
+func setupClusters(w *Workspace) {
+	doc := js.Global.Get("document")
+	sel := doc.Call("getElementById", "cluster")
+	namespace := doc.Call("getElementById", "namespace")
+	go func() {
+		clusters, err := loadClusters()
+		if err != nil {
+			SetToast("toaster", ToastError, err.Error())
+			return
+		}
+		if len(clusters) == 0 {
+			SetToast("toaster", ToastError, "You may not use any clusters")
+			return
+		}
+		byName := make(map[string]clusterTarget)
+		for _, c := range clusters {
+			byName[c.Name] = c
+			opt := doc.Call("createElement", "option")
+			opt.Set("value", c.Name)
+			opt.Set("textContent", c.Name)
+			if c.Context != "" {
+				opt.Set("textContent", fmt.Sprintf("%s (%s)", c.Name, c.Context))
+			}
+			sel.Call("appendChild", opt)
+		}
+		changed := func(c clusterTarget) {
+			namespace.Set("placeholder", fmt.Sprintf("Namespace (%s)", c.Namespace))
+			go func() {
+				w.Clusters() <- c
+			}()
+		}
+		sel.Call("addEventListener", "change", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+			changed(byName[sel.Get("value").String()])
+			return nil
+		}), false)
+		changed(clusters[0])
+		sel.Set("disabled", nil)
+	}()
+}
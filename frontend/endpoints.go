@@ -0,0 +1,553 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// maxMenuEvents is how many of a node's most recent events its menu shows.
+const maxMenuEvents = 10
+
+// kubectlProxyAddr is where `kubectl proxy` listens by default.
+const kubectlProxyAddr = "http://localhost:8001"
+
+// endpoint is a url at which something deployed from the workspace can be
+// reached.
+type endpoint struct {
+	desc string
+	url  string
+}
+
+// nodeAddressList is the subset of a NodeList needed to find node addresses.
+type nodeAddressList struct {
+	Items []struct {
+		ObjectMeta `json:"metadata,omitempty"`
+		Status     struct {
+			Addresses []NodeAddress `json:"addresses,omitempty"`
+		} `json:"status,omitempty"`
+	} `json:"items"`
+}
+
+// nodeAddressPreference is the order in which node addresses are tried when
+// picking one address per node.
+var nodeAddressPreference = []NodeAddressType{NodeExternalIP, NodeLegacyHostIP, NodeInternalIP, NodeHostName}
+
+// getNodeAddresses returns one address for each node in the cluster.
+func (ws *workspaceState) getNodeAddresses() ([]string, error) {
+	var nodes nodeAddressList
+	if err := ws.kubectlGet("", "nodes", "", &nodes); err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, node := range nodes.Items {
+	preference:
+		for _, typ := range nodeAddressPreference {
+			for _, addr := range node.Status.Addresses {
+				if addr.Type == typ {
+					addrs = append(addrs, addr.Address)
+					break preference
+				}
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// endpointSource is a service or ingress that endpoints can be looked up on.
+// Sources are taken from the workspace's state so that the lookups, which talk
+// to the cluster, can run outside of run.
+type endpointSource struct {
+	namespace string
+
+	// name is the name of the service or Ingress object.  If port is non-zero
+	// then only that service port is considered.
+	name string
+	port int
+
+	// ingress, if set, is an http ingress node to look up in the Ingress
+	// object instead of a service.
+	ingress *portObj
+}
+
+// endpointSources returns everything to look up to find every url at which p
+// can be reached.  For an ingress node that's everything reachable through that
+// ingress, for a container it's everything reachable on its service.
+func (ws *workspaceState) endpointSources(p *pod) ([]endpointSource, error) {
+	var sources []endpointSource
+	for _, e := range ws.edges {
+		if !e.complete || e.dst.pod.manifest == nil {
+			continue
+		}
+		po, ok := e.src.obj.(*portObj)
+		if !ok {
+			continue
+		}
+		switch {
+		case e.src.pod == p && po.typ != ingressHTTP:
+			port, err := ws.servicePortFor(e)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, endpointSource{
+				namespace: ws.namespaceOf(e.dst.pod),
+				name:      ws.serviceName(e.dst.pod),
+				port:      port,
+			})
+
+		case e.src.pod == p || (e.dst.pod == p && po.typ == ingressHTTP):
+			ingress := *po
+			sources = append(sources, endpointSource{
+				namespace: ws.namespaceOf(e.dst.pod),
+				name:      ingressName(),
+				ingress:   &ingress,
+			})
+		}
+	}
+	if p.manifest != nil {
+		sources = append(sources, endpointSource{
+			namespace: ws.namespaceOf(p),
+			name:      ws.serviceName(p),
+		})
+	}
+	return sources, nil
+}
+
+// endpointsFrom looks up the urls of every source.  Sources that aren't on the
+// cluster are skipped and reported by notDeployed.
+func (ws *workspaceState) endpointsFrom(sources []endpointSource) (eps []endpoint, notDeployed bool, err error) {
+	for _, src := range sources {
+		var more []endpoint
+		if src.ingress != nil {
+			more, err = ws.ingressEndpoints(src.namespace, src.name, src.ingress)
+		} else {
+			more, err = ws.serviceEndpoints(src.namespace, src.name, src.port)
+		}
+		if isNotFound(err) {
+			notDeployed = true
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		eps = append(eps, more...)
+	}
+	return eps, notDeployed, nil
+}
+
+// serviceEndpoints returns the urls for the service called name in ns.  If
+// only is non-zero then only that service port is considered.
+func (ws *workspaceState) serviceEndpoints(ns, name string, only int) ([]endpoint, error) {
+	s, err := ws.getService(ns, name)
+	if isNotFound(err) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get service %s: %v", name, err)
+	}
+	var eps []endpoint
+	var nodes []string
+	for _, sp := range s.Spec.Ports {
+		if only != 0 && sp.Port != only {
+			continue
+		}
+		for _, ingress := range s.Status.LoadBalancer.Ingress {
+			host := ingress.IP
+			if host == "" {
+				host = ingress.Hostname
+			}
+			if host == "" {
+				continue
+			}
+			eps = append(eps, endpoint{
+				desc: fmt.Sprintf("%s %s via load balancer", name, sp.Name),
+				url:  fmt.Sprintf("http://%s:%d", host, sp.Port),
+			})
+		}
+		if sp.NodePort != 0 {
+			if nodes == nil {
+				if nodes, err = ws.getNodeAddresses(); err != nil {
+					return nil, fmt.Errorf("unable to get nodes: %v", err)
+				}
+			}
+			for _, node := range nodes {
+				eps = append(eps, endpoint{
+					desc: fmt.Sprintf("%s %s via node %s", name, sp.Name, node),
+					url:  fmt.Sprintf("http://%s:%d", node, sp.NodePort),
+				})
+			}
+		}
+		proxied := name
+		if sp.Name != "" {
+			proxied = fmt.Sprintf("%s:%s", name, sp.Name)
+		}
+		eps = append(eps, endpoint{
+			desc: fmt.Sprintf("%s %s via kubectl proxy", name, sp.Name),
+			url:  fmt.Sprintf("%s/api/v1/proxy/namespaces/%s/services/%s/", kubectlProxyAddr, ns, proxied),
+		})
+	}
+	return eps, nil
+}
+
+// ingressEndpoints returns the urls routed by the http ingress po, which is
+// merged into the Ingress object called name in namespace.
+func (ws *workspaceState) ingressEndpoints(namespace, name string, po *portObj) ([]endpoint, error) {
+	if po.host != "" {
+		return []endpoint{{
+			desc: fmt.Sprintf("%s via ingress", po),
+			url:  fmt.Sprintf("http://%s%s", po.host, po.path),
+		}}, nil
+	}
+	var ingress Ingress
+	if err := ws.kubectlGet(namespace, "ingress", name, &ingress); isNotFound(err) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to get ingress %s: %v", name, err)
+	}
+	var eps []endpoint
+	for _, lb := range ingress.Status.LoadBalancer.Ingress {
+		host := lb.IP
+		if host == "" {
+			host = lb.Hostname
+		}
+		if host == "" {
+			continue
+		}
+		eps = append(eps, endpoint{
+			desc: fmt.Sprintf("%s via ingress", po),
+			url:  fmt.Sprintf("http://%s%s", host, po.path),
+		})
+	}
+	return eps, nil
+}
+
+// showNodeMenu fills the context menu with the actions and endpoints for p and
+// shows it at pt, which is relative to the canvas.  It's called from run, and
+// only the endpoint lookups are left to run once it returns.
+func (w *Workspace) showNodeMenu(ws *workspaceState, p *pod, pt point) {
+	var items []*js.Object
+	if p.manifest != nil {
+		target := ws.logTarget(p)
+		items = append(items, w.namespaceItem(ws, p))
+		if p.imported != nil {
+			items = append(items, w.importedMenuItem(ws, p))
+		} else {
+			items = append(items, w.platformItem(p))
+		}
+		if p.undeployable != "" {
+			item := w.menuItem("Not deployable: " + p.undeployable)
+			item.Get("style").Set("color", "rgb(200, 0, 0)")
+			items = append(items, item)
+		}
+		items = append(items, w.logItem(target))
+		items = append(items, w.portItems(p, target)...)
+		items = append(items, w.eventItems(p)...)
+	}
+	items = append(items, w.layerItems(p)...)
+
+	sources, err := ws.endpointSources(p)
+	cluster := ws.cluster
+	go func() {
+		if err == nil {
+			var more []*js.Object
+			more, err = w.endpointItems(cluster, sources)
+			items = append(items, more...)
+		}
+		if err != nil {
+			SetToast("toaster", ToastWarning, fmt.Sprintf("Unable to find endpoints: %v", err))
+		}
+		w.showMenu(items, pt)
+	}()
+}
+
+// showMenu shows items in the context menu at pt, which is relative to the
+// canvas, unless there aren't any.
+func (w *Workspace) showMenu(items []*js.Object, pt point) {
+	if len(items) == 0 {
+		return
+	}
+	menu := w.doc.Call("getElementById", "context-menu")
+	menu.Set("innerHTML", "")
+	list := w.doc.Call("createElement", "ul")
+	list.Set("className", "pure-menu-list")
+	for _, item := range items {
+		list.Call("appendChild", item)
+	}
+	menu.Call("appendChild", list)
+	menu.Get("style").Set("left", fmt.Sprintf("%dpx", pt.x+w.x))
+	menu.Get("style").Set("top", fmt.Sprintf("%dpx", pt.y+w.y))
+	menu.Get("style").Set("display", "block")
+}
+
+// menuItem returns a menu item holding text, which buttons can be appended to.
+func (w *Workspace) menuItem(text string) *js.Object {
+	item := w.doc.Call("createElement", "li")
+	item.Set("className", "pure-menu-item")
+	if text != "" {
+		span := w.doc.Call("createElement", "span")
+		span.Set("textContent", text)
+		item.Call("appendChild", span)
+	}
+	return item
+}
+
+// logTarget returns where the logs and shells of p's containers are found.
+func (ws *workspaceState) logTarget(p *pod) logTarget {
+	name := makeNiceName(p.manifest.Name.String())
+	target := logTarget{
+		title:     name,
+		cluster:   ws.cluster.Name,
+		namespace: ws.namespaceOf(p),
+		selector:  map[string]string{"flow-id": name},
+		container: name,
+	}
+	if in := p.imported; in != nil {
+		target.selector = in.selector()
+		target.container = ""
+		if in.rc != nil {
+			target.container = in.rc.Spec.Template.Spec.Containers[0].Name
+		}
+	}
+	return target
+}
+
+// namespaceItem shows the namespace of p and, unless it was imported, lets it
+// be changed.
+func (w *Workspace) namespaceItem(ws *workspaceState, p *pod) *js.Object {
+	item := w.menuItem(fmt.Sprintf("Namespace: %s ", ws.namespaceOf(p)))
+	if p.imported != nil {
+		return item
+	}
+	current := p.namespace
+	item.Call("appendChild", w.menuButton("Change", func() {
+		w.hideMenu()
+		ns := js.Global.Get("window").Call("prompt", "Namespace for this node, leave empty to use the workspace's namespace", current)
+		if ns == nil {
+			return
+		}
+		go func() {
+			w.nodeNS <- nodeNamespace{pod: p, name: ns.String()}
+		}()
+	}))
+	return item
+}
+
+// platformItem shows the platform of p and lets it be changed, which finds the
+// image for the new platform.
+func (w *Workspace) platformItem(p *pod) *js.Object {
+	current, source := p.platform, p.source
+	item := w.menuItem(fmt.Sprintf("Platform: %s ", current))
+	item.Call("appendChild", w.menuButton("Change", func() {
+		w.hideMenu()
+		str := js.Global.Get("window").Call("prompt", "Platform for this node, as os/arch", current.String())
+		if str == nil {
+			return
+		}
+		pl, err := parsePlatform(str.String())
+		if err != nil {
+			SetToast("toaster", ToastError, err.Error())
+			return
+		}
+		go func() {
+			info, err := fetchImage(source, pl)
+			if err != nil {
+				SetToast("toaster", ToastError, err.Error())
+				return
+			}
+			w.nodePlatform <- nodePlatform{pod: p, platform: pl, info: info}
+			SetToast("toaster", ToastSuccess, fmt.Sprintf("Using %s for %s", info.Image, pl))
+		}()
+	}))
+	return item
+}
+
+// logItem offers the logs of, and a shell in, the containers of target.
+func (w *Workspace) logItem(target logTarget) *js.Object {
+	item := w.menuItem("")
+	item.Call("appendChild", w.menuButton("Logs", func() {
+		w.hideMenu()
+		logs.show(target)
+	}))
+	item.Call("appendChild", w.menuButton("Shell", func() {
+		w.hideMenu()
+		terminal.show(execTarget(target))
+	}))
+	return item
+}
+
+// portItems offers to forward each port of p, and lists the forwards that are
+// already running.
+func (w *Workspace) portItems(p *pod, target logTarget) []*js.Object {
+	var items []*js.Object
+	for _, port := range p.manifest.App.Ports {
+		remote := int(port.Port)
+		item := w.menuItem(fmt.Sprintf("Port %s:%d ", port.Name, remote))
+		item.Call("appendChild", w.menuButton("Forward", func() {
+			w.hideMenu()
+			op := kubeOp{Cluster: target.cluster, Namespace: target.namespace, Selector: target.selector, RemotePort: remote}
+			go func() {
+				pf, err := startPortForward(op)
+				if err != nil {
+					SetToast("toaster", ToastError, err.Error())
+					return
+				}
+				SetToast("toaster", ToastSuccess, fmt.Sprintf("Forwarding %s to %s:%d", pf.address(), pf.Pod, remote))
+			}()
+		}))
+		items = append(items, item)
+		for _, pf := range forwards {
+			pf := pf
+			if pf.Cluster != target.cluster || pf.Namespace != target.namespace || !sameLabels(pf.Selector, target.selector) || pf.RemotePort != remote {
+				continue
+			}
+			item := w.menuItem(fmt.Sprintf("  Forwarded from %s ", pf.address()))
+			item.Call("appendChild", w.menuButton("Copy ssh", func() {
+				copyToClipboard(w.doc, pf.sshCommand())
+				SetToast("toaster", ToastSuccess, fmt.Sprintf("Copied %s, which makes the port-forward reachable at localhost:%d", pf.sshCommand(), pf.LocalPort))
+				w.hideMenu()
+			}))
+			item.Call("appendChild", w.menuButton("Stop", func() {
+				w.hideMenu()
+				go func() {
+					if err := stopPortForward(pf.ID); err != nil {
+						SetToast("toaster", ToastError, err.Error())
+						return
+					}
+					SetToast("toaster", ToastSuccess, fmt.Sprintf("Stopped forwarding %s", pf.address()))
+				}()
+			}))
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// eventItems lists the most recent events of p.
+func (w *Workspace) eventItems(p *pod) []*js.Object {
+	events := p.events
+	if len(events) > maxMenuEvents {
+		events = events[len(events)-maxMenuEvents:]
+	}
+	var items []*js.Object
+	for i := range events {
+		ev := &events[i]
+		item := w.menuItem("")
+		item.Set("textContent", "Event: "+ev.text())
+		if ev.warning() {
+			item.Get("style").Set("color", "rgb(200, 0, 0)")
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// layerItems lists the dependencies of p's image.
+func (w *Workspace) layerItems(p *pod) []*js.Object {
+	var items []*js.Object
+	for _, layer := range p.layers {
+		item := w.menuItem("")
+		text := fmt.Sprintf("%sLayer: %s %s", strings.Repeat("  ", layer.Depth-1), layer.Name, layer.Labels["version"])
+		if layer.Error != "" {
+			text = fmt.Sprintf("%s (%s)", text, layer.Error)
+			item.Get("style").Set("color", "rgb(200, 0, 0)")
+		} else if layer.Signature != nil && !layer.Signature.verified() {
+			text = fmt.Sprintf("%s (%s)", text, layer.Signature.Status)
+		}
+		item.Set("textContent", text)
+		items = append(items, item)
+	}
+	return items
+}
+
+// endpointItems looks up sources on cluster and offers to open or copy every
+// url found.  It talks to the cluster, so it mustn't be called from run.
+func (w *Workspace) endpointItems(cluster clusterTarget, sources []endpointSource) ([]*js.Object, error) {
+	// Looking things up on the cluster needs nothing else from the state.
+	ws := &workspaceState{cluster: cluster}
+	eps, notDeployed, err := ws.endpointsFrom(sources)
+	if err != nil {
+		return nil, err
+	}
+	var items []*js.Object
+	if notDeployed {
+		items = append(items, w.menuItem(fmt.Sprintf("Not deployed to %s", ws.clusterName())))
+	} else if len(eps) == 0 && len(sources) > 0 {
+		items = append(items, w.menuItem("Nothing is reachable yet, its load balancer may not be ready"))
+	}
+	for _, ep := range eps {
+		ep := ep
+		item := w.menuItem(fmt.Sprintf("%s: %s ", ep.desc, ep.url))
+		item.Call("appendChild", w.menuButton("Open", func() {
+			js.Global.Get("window").Call("open", ep.url)
+			w.hideMenu()
+		}))
+		item.Call("appendChild", w.menuButton("Copy", func() {
+			copyToClipboard(w.doc, ep.url)
+			SetToast("toaster", ToastSuccess, fmt.Sprintf("Copied %s", ep.url))
+			w.hideMenu()
+		}))
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// importedMenuItem describes where p was imported from and offers to adopt it.
+func (w *Workspace) importedMenuItem(ws *workspaceState, p *pod) *js.Object {
+	item := w.doc.Call("createElement", "li")
+	item.Set("className", "pure-menu-item")
+	text := w.doc.Call("createElement", "span")
+	item.Call("appendChild", text)
+	cluster := ws.clusterName()
+	if !p.external() {
+		text.Set("textContent", "Imported, adopted by flow")
+		return item
+	}
+	why := p.imported.adoptable()
+	if why != "" {
+		text.Set("textContent", fmt.Sprintf("Imported, external because %s", why))
+		return item
+	}
+	text.Set("textContent", "Imported, external ")
+	item.Call("appendChild", w.menuButton("Adopt", func() {
+		w.hideMenu()
+		msg := fmt.Sprintf("Let flow deploy %s from now on?  Make It So will replace its objects on %s, and Tear Down will delete them.", p.manifest.Name, cluster)
+		if !js.Global.Get("window").Call("confirm", msg).Bool() {
+			return
+		}
+		go func() {
+			w.adopt <- p
+		}()
+	}))
+	return item
+}
+
+func (w *Workspace) menuButton(label string, f func()) *js.Object {
+	button := w.doc.Call("createElement", "button")
+	button.Set("type", "button")
+	button.Set("className", "pure-button")
+	button.Set("textContent", label)
+	button.Call("addEventListener", "click", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		f()
+		return nil
+	}), false)
+	return button
+}
+
+func (w *Workspace) hideMenu() {
+	w.doc.Call("getElementById", "context-menu").Get("style").Set("display", "none")
+}
+
+// inMenu returns true if the target of the event e is inside the context menu.
+func (w *Workspace) inMenu(e *js.Object) bool {
+	return w.doc.Call("getElementById", "context-menu").Call("contains", e.Get("target")).Bool()
+}
+
+func copyToClipboard(doc *js.Object, text string) {
+	area := doc.Call("createElement", "textarea")
+	area.Set("value", text)
+	doc.Get("body").Call("appendChild", area)
+	area.Call("select")
+	doc.Call("execCommand", "copy")
+	doc.Get("body").Call("removeChild", area)
+}
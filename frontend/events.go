@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// maxNodeEvents is how many events are kept for each node.
+const maxNodeEvents = 50
+
+// eventRetryDelay is how long to wait before watching a namespace's events
+// again after the watch ends.
+const eventRetryDelay = 10 * time.Second
+
+// flowEvent is an event about one of the objects flow deployed, see /events/.
+type flowEvent struct {
+	FlowID    string `json:"flowID"`
+	Workspace string `json:"workspace"`
+	UID       string `json:"uid"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Reason    string `json:"reason"`
+	Message   string `json:"message"`
+	Count     int    `json:"count"`
+	FirstSeen string `json:"firstSeen"`
+	LastSeen  string `json:"lastSeen"`
+}
+
+func (e *flowEvent) warning() bool {
+	return e.Type == "Warning"
+}
+
+// nodeEvent is an event that arrived from the watch on a namespace.
+type nodeEvent struct {
+	watch string
+	event flowEvent
+}
+
+// eventWatchKey identifies the watch on the events of the workspace's objects
+// in namespace on cluster.
+func eventWatchKey(cluster, namespace string) string {
+	return workspaceID + "/" + cluster + "/" + namespace
+}
+
+// watchEvents makes sure that the events of every namespace in use on the
+// current cluster are being watched, and stops watching any others.
+func (ws *workspaceState) watchEvents(w *Workspace) {
+	if ws.eventWatches == nil {
+		ws.eventWatches = make(map[string]*js.Object)
+	}
+	want := make(map[string]string)
+	for _, ns := range ws.namespacesInUse() {
+		want[eventWatchKey(ws.cluster.Name, ns)] = ns
+	}
+	for key, req := range ws.eventWatches {
+		if _, ok := want[key]; !ok {
+			req.Call("abort")
+			delete(ws.eventWatches, key)
+		}
+	}
+	for key, ns := range want {
+		if _, ok := ws.eventWatches[key]; !ok {
+			ws.eventWatches[key] = w.startEventWatch(key, ws.cluster.Name, ns)
+		}
+	}
+}
+
+// startEventWatch streams the events of the workspace's objects in namespace on
+// cluster to the workspace, one json object per line.  A watch that the server
+// refuses isn't tried again until the cluster or the workspace id changes.
+func (w *Workspace) startEventWatch(key, cluster, namespace string) *js.Object {
+	q := url.Values{}
+	q.Set("cluster", cluster)
+	q.Set("namespace", namespace)
+	q.Set("workspace", workspaceID)
+	q.Set("watch", "true")
+	// pending is the start of a line that hasn't all arrived yet.
+	pending := ""
+	return streamGet("/events/?"+q.Encode(), func(data string) {
+		pending += data
+		end := strings.LastIndex(pending, "\n") + 1
+		if end == 0 {
+			return
+		}
+		lines := strings.Split(strings.TrimSpace(pending[:end]), "\n")
+		pending = pending[end:]
+		go func() {
+			for _, line := range lines {
+				var ev flowEvent
+				if err := json.Unmarshal([]byte(line), &ev); err != nil {
+					log.Printf("Unable to parse event %q: %v", line, err)
+					continue
+				}
+				w.events <- nodeEvent{watch: key, event: ev}
+			}
+		}()
+	}, func(status int, body string) {
+		if status != 200 {
+			log.Printf("Watching events in %s ended: %d %s", key, status, body)
+		}
+		if status >= 400 && status < 500 {
+			SetToast("toaster", ToastWarning, fmt.Sprintf("Unable to watch events in %s: %s", namespace, strings.TrimSpace(body)))
+			return
+		}
+		go func() {
+			time.Sleep(eventRetryDelay)
+			w.watchEnded <- key
+		}()
+	})
+}
+
+// addEvent records ev on the nodes it's about.
+func (ws *workspaceState) addEvent(ne nodeEvent) {
+	for _, p := range ws.pods {
+		if p.manifest == nil || makeNiceName(p.manifest.Name.String()) != ne.event.FlowID || ne.event.Workspace != workspaceID {
+			continue
+		}
+		if eventWatchKey(ws.cluster.Name, ws.namespaceOf(p)) != ne.watch {
+			continue
+		}
+		replaced := false
+		for i := range p.events {
+			if p.events[i].UID == ne.event.UID {
+				p.events[i] = ne.event
+				replaced = true
+			}
+		}
+		if !replaced {
+			p.events = append(p.events, ne.event)
+		}
+		if len(p.events) > maxNodeEvents {
+			p.events = p.events[len(p.events)-maxNodeEvents:]
+		}
+	}
+}
+
+// stopEventWatches stops every watch and forgets every event, for when the
+// cluster changes.
+func (ws *workspaceState) stopEventWatches() {
+	for key, req := range ws.eventWatches {
+		req.Call("abort")
+		delete(ws.eventWatches, key)
+	}
+	for _, p := range ws.pods {
+		p.events = nil
+	}
+}
+
+// warnings returns how many of p's events are warnings.
+func (p *pod) warnings() int {
+	n := 0
+	for i := range p.events {
+		if p.events[i].warning() {
+			n++
+		}
+	}
+	return n
+}
+
+// text describes e for the node menu.
+func (e *flowEvent) text() string {
+	text := fmt.Sprintf("%s %s/%s: %s", e.Reason, e.Kind, e.Name, e.Message)
+	if e.Count > 1 {
+		text = fmt.Sprintf("%s (x%d)", text, e.Count)
+	}
+	if e.LastSeen != "" {
+		text = fmt.Sprintf("%s %s", e.LastSeen, text)
+	}
+	return text
+}
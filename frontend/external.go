@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gopherjs/gopherjs/js"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+)
+
+// externalObj is the anchor object of an external endpoint node, a dependency
+// that flow doesn't deploy.  It can satisfy host-port flags just like a port on
+// a container can.  It's either a host, which is a hostname or an IP, or an
+// existing Service in the cluster.
+type externalObj struct {
+	host    string
+	service string
+	port    int
+
+	// If publish is set then flow creates a selector-less Service of that name,
+	// and the Endpoints behind it, so that consumers in the cluster reach host
+	// by name.  Only IPs can be published.
+	publish string
+}
+
+// serviceLabelRe matches the names that a Service may have.
+var serviceLabelRe = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+
+func (eo *externalObj) String() string {
+	port := strconv.Itoa(eo.port)
+	switch {
+	case eo.service != "":
+		return fmt.Sprintf("svc/%s:%s", eo.service, port)
+	case eo.publish != "":
+		return fmt.Sprintf("%s=%s", eo.publish, net.JoinHostPort(eo.host, port))
+	}
+	return net.JoinHostPort(eo.host, port)
+}
+
+// parseExternal parses the spec for an external endpoint node, which is
+// host:port, name=ip:port to publish ip as the Service name, or
+// svc/name[.namespace]:port for an existing Service.  The namespace of an
+// existing Service is returned separately, and is empty if it wasn't given.
+func parseExternal(spec string) (*externalObj, string, error) {
+	spec = strings.TrimSpace(spec)
+	eo := &externalObj{}
+	var namespace string
+	if strings.HasPrefix(spec, "svc/") {
+		spec = strings.TrimPrefix(spec, "svc/")
+		colon := strings.LastIndex(spec, ":")
+		if colon == -1 {
+			return nil, "", fmt.Errorf("an existing service is given as svc/name[.namespace]:port, got %q", spec)
+		}
+		eo.service = spec[:colon]
+		if dot := strings.Index(eo.service, "."); dot != -1 {
+			namespace = eo.service[dot+1:]
+			eo.service = eo.service[:dot]
+			if !serviceLabelRe.MatchString(namespace) {
+				return nil, "", fmt.Errorf("invalid namespace %q", namespace)
+			}
+		}
+		if !serviceLabelRe.MatchString(eo.service) {
+			return nil, "", fmt.Errorf("invalid service name %q", eo.service)
+		}
+		spec = spec[colon+1:]
+	} else {
+		if eq := strings.Index(spec, "="); eq != -1 {
+			eo.publish = spec[:eq]
+			spec = spec[eq+1:]
+			if len(eo.publish) > 63 || !serviceLabelRe.MatchString(eo.publish) {
+				return nil, "", fmt.Errorf("invalid service name %q", eo.publish)
+			}
+		}
+		host, port, err := net.SplitHostPort(spec)
+		if err != nil || host == "" {
+			return nil, "", fmt.Errorf("an external endpoint is given as [name=]host:port, got %q", spec)
+		}
+		eo.host = host
+		spec = port
+		if eo.publish != "" {
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return nil, "", fmt.Errorf("only an IP can be published as a service, %s is a hostname", host)
+			}
+			if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+				return nil, "", fmt.Errorf("%s can't be published as a service, it's not reachable from the cluster", host)
+			}
+		}
+	}
+	n, err := strconv.ParseInt(spec, 10, 32)
+	if err != nil || n <= 0 || n > 65535 {
+		return nil, "", fmt.Errorf("unable to parse %q as a port", spec)
+	}
+	eo.port = int(n)
+	return eo, namespace, nil
+}
+
+// externalNode is an external endpoint node to add to the workspace, along with
+// the namespace of the existing Service it stands for, if any.
+type externalNode struct {
+	obj       *externalObj
+	namespace string
+}
+
+func MakeExternal(eo *externalObj, ctx *js.Object) *pod {
+	p := &pod{
+		ext: eo,
+		x:   10,
+		y:   10,
+		dx:  100,
+		dy:  100,
+	}
+	ctx.Set("font", "15px Monaco")
+	if width := ctx.Call("measureText", eo.String()).Get("width").Int() + 20; width > p.dx {
+		p.dx = width
+	}
+	p.anchors = append(p.anchors, &podAnchor{
+		pod:    p,
+		text:   "",
+		edgePt: point{p.dx / 2, 0},
+		textPt: point{p.dx / 2, 12},
+		obj:    eo,
+	})
+
+	return p
+}
+
+// externalHost returns the host that the source of e should use to reach the
+// external endpoint at the destination of e.  Published and existing Services
+// are reached like any other Service, everything else by its host.
+func (ws *workspaceState) externalHost(e *edge) (string, error) {
+	eo := e.dst.obj.(*externalObj)
+	if eo.service == "" && eo.publish == "" {
+		return eo.host, nil
+	}
+	return ws.serviceHost(e)
+}
+
+// createExternalObjects returns the selector-less Service that publishes the
+// external endpoint node p, and the Endpoints that route it to p's IP.
+func (ws *workspaceState) createExternalObjects(p *pod) (*Service, *Endpoints) {
+	eo := p.ext
+	meta := ObjectMeta{
+		Labels:    objectLabels(eo.publish),
+		Name:      eo.publish,
+		Namespace: ws.namespaceOf(p),
+	}
+	service := &Service{
+		TypeMeta: unversioned.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Service",
+		},
+		ObjectMeta: meta,
+		Spec: ServiceSpec{
+			Ports: []ServicePort{{
+				Port:       eo.port,
+				TargetPort: IntOrString{IntVal: eo.port},
+				Protocol:   ProtocolTCP,
+			}},
+		},
+	}
+	endpoints := &Endpoints{
+		TypeMeta: unversioned.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Endpoints",
+		},
+		ObjectMeta: meta,
+		Subsets: []EndpointSubset{{
+			Addresses: []EndpointAddress{{IP: eo.host}},
+			Ports: []EndpointPort{{
+				Port:     eo.port,
+				Protocol: ProtocolTCP,
+			}},
+		}},
+	}
+	return service, endpoints
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// importedNode is what a node imported from the cluster was built from.  An
+// imported node is external: other nodes can be connected to it, but flow never
+// deploys or deletes it.  Adopting it makes flow apply its own version of the
+// node's objects, which keeps their selectors so that the pods already running
+// stay theirs.
+type importedNode struct {
+	// rc is nil for a service that doesn't select any replication controller.
+	rc      *ReplicationController
+	service *Service
+
+	// args are the container's arguments that aren't represented by edges.
+	args []string
+
+	// volumes and mounts are the ones that aren't represented by disk nodes.
+	volumes []Volume
+	mounts  []VolumeMount
+
+	adopted bool
+}
+
+// adoptable returns an empty string if flow can take over n, otherwise why it
+// can't.
+func (n *importedNode) adoptable() string {
+	switch {
+	case n.rc == nil:
+		return "it has no replication controller"
+	case makeNiceName(n.rc.Name) != n.rc.Name:
+		return fmt.Sprintf("flow can't name objects %s", n.rc.Name)
+	}
+	return ""
+}
+
+// selector returns the labels of n's pods.
+func (n *importedNode) selector() map[string]string {
+	if n.rc == nil {
+		return n.service.Spec.Selector
+	}
+	if len(n.rc.Spec.Selector) > 0 {
+		return n.rc.Spec.Selector
+	}
+	return n.rc.Spec.Template.Labels
+}
+
+// importedGraph is the nodes and edges imported from a namespace.
+type importedGraph struct {
+	namespace string
+	pods      []*pod
+	edges     []*edge
+
+	// skipped describes what couldn't be imported.
+	skipped []string
+}
+
+// flagArgRe matches the container arguments that may be host-port flags.  Only
+// flags given as --flag=host:port whose names are valid in an annotation are
+// recognized.
+var flagArgRe = regexp.MustCompile(`^--?([a-z0-9][-a-z0-9_.]*)=(.+)$`)
+
+// importNamespace reads the services and replication controllers in namespace
+// on cluster that flow didn't deploy and sends the graph that they make to the
+// workspace.  It runs outside of the workspace's loop, so it's given the cluster
+// rather than the workspace's state, which may change underneath it.
+func (w *Workspace) importNamespace(cluster clusterTarget, namespace string) {
+	ws := &workspaceState{cluster: cluster}
+	SetToast("toaster", ToastNone, fmt.Sprintf("Importing from %s on %s", namespace, ws.clusterName()))
+	rcs, err := ws.listObjects(namespace, "replicationcontrollers")
+	if err != nil {
+		SetToast("toaster", ToastError, err.Error())
+		return
+	}
+	services, err := ws.listObjects(namespace, "services")
+	if err != nil {
+		SetToast("toaster", ToastError, err.Error())
+		return
+	}
+	w.imports <- buildImport(w.ctx, w.dx, namespace, rcs, services)
+}
+
+// listObjects returns every object of kind in namespace, undecoded so that one
+// object that can't be decoded doesn't stop the others from being imported.
+func (ws *workspaceState) listObjects(namespace, kind string) ([]json.RawMessage, error) {
+	var list struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := ws.kubectlGet(namespace, kind, "", &list); err != nil {
+		return nil, fmt.Errorf("unable to list %s in %s: %v", kind, namespace, err)
+	}
+	return list.Items, nil
+}
+
+// buildImport reconstructs the graph made by rcs and services, laying it out in
+// rows that fit in width.  Each replication controller becomes a node, along with
+// the first service that selects its pods, and every other service becomes a
+// node of its own.  Volumes that are disks become disk nodes, and arguments that
+// point at a service become host-port flags connected to it.
+func buildImport(ctx *js.Object, width int, namespace string, rawRCs, rawServices []json.RawMessage) *importedGraph {
+	g := &importedGraph{namespace: namespace}
+	var rcs []*ReplicationController
+	for _, raw := range rawRCs {
+		rc := &ReplicationController{}
+		if err := json.Unmarshal(raw, rc); err != nil {
+			g.skipped = append(g.skipped, fmt.Sprintf("a replication controller (%v)", err))
+			continue
+		}
+		if rc.Labels[flowManagedLabel] == "true" {
+			continue
+		}
+		if rc.Spec.Template == nil || len(rc.Spec.Template.Spec.Containers) == 0 {
+			g.skipped = append(g.skipped, fmt.Sprintf("%s (no containers)", rc.Name))
+			continue
+		}
+		rcs = append(rcs, rc)
+	}
+	var services []*Service
+	for _, raw := range rawServices {
+		s := &Service{}
+		if err := json.Unmarshal(raw, s); err != nil {
+			g.skipped = append(g.skipped, fmt.Sprintf("a service (%v)", err))
+			continue
+		}
+		if s.Labels[flowManagedLabel] == "true" || (s.Name == "kubernetes" && namespace == NamespaceDefault) {
+			continue
+		}
+		services = append(services, s)
+	}
+	sort.Slice(rcs, func(i, j int) bool { return rcs[i].Name < rcs[j].Name })
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+
+	var nodes []*importedNode
+	byService := make(map[*Service]*importedNode)
+	for _, rc := range rcs {
+		n := &importedNode{rc: rc}
+		for _, s := range services {
+			if byService[s] == nil && selects(s.Spec.Selector, rc.Spec.Template.Labels) {
+				n.service = s
+				byService[s] = n
+				break
+			}
+		}
+		nodes = append(nodes, n)
+	}
+	for _, s := range services {
+		if byService[s] == nil {
+			n := &importedNode{service: s}
+			byService[s] = n
+			nodes = append(nodes, n)
+		}
+	}
+
+	// addrs are the hosts that a service can be reached at from the namespace.
+	addrs := make(map[string]*Service)
+	for _, s := range services {
+		addrs[s.Name] = s
+		addrs[s.Name+"."+namespace] = s
+		addrs[s.Name+"."+namespace+".svc"] = s
+		addrs[s.Name+"."+namespace+".svc."+clusterDomain] = s
+		if s.Spec.ClusterIP != "" && s.Spec.ClusterIP != ClusterIPNone {
+			addrs[s.Spec.ClusterIP] = s
+		}
+	}
+
+	type mountEdge struct {
+		src   *importedNode
+		mount string
+		disk  string
+	}
+	var flagEdges []importedFlag
+	var mountEdges []mountEdge
+	var diskNames []string
+	disks := make(map[string]*VolumeSource)
+	pods := make(map[*importedNode]*pod)
+	for _, n := range nodes {
+		name := n.service.Name
+		if n.rc != nil {
+			name = n.rc.Name
+		}
+		id, err := types.NewACIdentifier(name)
+		if err != nil {
+			g.skipped = append(g.skipped, fmt.Sprintf("%s (%v)", name, err))
+			continue
+		}
+		manifest := &schema.ImageManifest{Name: *id, App: &types.App{}}
+		addPort := func(portName string, port int, protocol Protocol) {
+			for _, p := range manifest.App.Ports {
+				if int(p.Port) == port {
+					return
+				}
+			}
+			if portName == "" {
+				portName = fmt.Sprintf("port-%d", port)
+			}
+			acName, err := types.NewACName(portName)
+			if err != nil {
+				acName = types.MustACName(fmt.Sprintf("port-%d", port))
+			}
+			if protocol == "" {
+				protocol = ProtocolTCP
+			}
+			manifest.App.Ports = append(manifest.App.Ports, types.Port{
+				Name:     *acName,
+				Protocol: strings.ToLower(string(protocol)),
+				Port:     uint(port),
+			})
+		}
+
+		var image string
+		if n.rc != nil {
+			spec := n.rc.Spec.Template.Spec
+			container := spec.Containers[0]
+			image = container.Image
+			if len(spec.Containers) > 1 {
+				g.skipped = append(g.skipped, fmt.Sprintf("all but the first container of %s", name))
+			}
+			for _, cp := range container.Ports {
+				addPort(cp.Name, cp.ContainerPort, cp.Protocol)
+			}
+
+			diskVolumes := make(map[string]string)
+			for _, v := range spec.Volumes {
+				var disk string
+				switch {
+				case v.GCEPersistentDisk != nil:
+					disk = v.GCEPersistentDisk.PDName
+				case v.PersistentVolumeClaim != nil:
+					disk = v.PersistentVolumeClaim.ClaimName
+				default:
+					n.volumes = append(n.volumes, v)
+					continue
+				}
+				diskVolumes[v.Name] = disk
+				if _, ok := disks[disk]; !ok {
+					source := v.VolumeSource
+					disks[disk] = &source
+					diskNames = append(diskNames, disk)
+				}
+			}
+			for _, vm := range container.VolumeMounts {
+				disk, ok := diskVolumes[vm.Name]
+				acName, err := types.NewACName(vm.Name)
+				if !ok || err != nil {
+					n.mounts = append(n.mounts, vm)
+					continue
+				}
+				manifest.App.MountPoints = append(manifest.App.MountPoints, types.MountPoint{Name: *acName, Path: vm.MountPath, ReadOnly: vm.ReadOnly})
+				mountEdges = append(mountEdges, mountEdge{src: n, mount: vm.Name, disk: disk})
+			}
+
+			flags := make(map[string]bool)
+			for _, arg := range container.Args {
+				if fe, ok := hostPortFlag(arg, addrs, byService); ok && !flags[fe.flag] {
+					fe.src = n
+					if ann, err := types.NewACIdentifier("required-flag/" + fe.flag); err == nil {
+						flags[fe.flag] = true
+						manifest.Annotations = append(manifest.Annotations, types.Annotation{
+							Name:  *ann,
+							Value: fmt.Sprintf("name=%s;type=host-port", fe.flag),
+						})
+						flagEdges = append(flagEdges, fe)
+						continue
+					}
+				}
+				n.args = append(n.args, arg)
+			}
+		}
+		if n.service != nil {
+			for _, sp := range n.service.Spec.Ports {
+				target := servicePortTarget(sp, n.containerPorts())
+				if target == 0 {
+					g.skipped = append(g.skipped, fmt.Sprintf("port %d of %s (no container port named %s)", sp.Port, n.service.Name, sp.TargetPort))
+					continue
+				}
+				addPort(sp.Name, target, sp.Protocol)
+			}
+		}
+
+		p := MakePod(manifest, ctx)
+		p.imported = n
+		p.namespace = namespace
+		p.image = image
+		p.platform = defaultPlatform
+		pods[n] = p
+		g.pods = append(g.pods, p)
+	}
+
+	diskPods := make(map[string]*pod)
+	for _, disk := range diskNames {
+		p := MakeDisk(disk, ctx)
+		p.volume = disks[disk]
+		diskPods[disk] = p
+		g.pods = append(g.pods, p)
+	}
+
+	for _, fe := range flagEdges {
+		src, dst := pods[fe.src], pods[fe.dst]
+		if src == nil || dst == nil {
+			continue
+		}
+		flag, target := fe.flag, servicePortTarget(fe.port, fe.dst.containerPorts())
+		e := &edge{
+			src: findAnchor(src, func(obj interface{}) bool {
+				rf, ok := obj.(*requiredFlag)
+				return ok && rf.flag == flag
+			}),
+			dst: findAnchor(dst, func(obj interface{}) bool {
+				port, ok := obj.(*types.Port)
+				return ok && int(port.Port) == target
+			}),
+			complete: true,
+			port:     fe.port.Port,
+		}
+		if e.src != nil && e.dst != nil && e.Check() == nil {
+			g.edges = append(g.edges, e)
+		}
+	}
+	for _, me := range mountEdges {
+		src := pods[me.src]
+		if src == nil {
+			continue
+		}
+		mount := me.mount
+		e := &edge{
+			src: findAnchor(src, func(obj interface{}) bool {
+				mp, ok := obj.(*types.MountPoint)
+				return ok && mp.Name.String() == mount
+			}),
+			dst:      diskPods[me.disk].anchors[0],
+			complete: true,
+		}
+		if e.src != nil && e.Check() == nil {
+			g.edges = append(g.edges, e)
+		}
+	}
+
+	// Containers are laid out first, then disks on rows of their own.
+	x, y := 10, 150
+	for i, p := range g.pods {
+		if (x > 10 && x+p.dx > width) || (p.disk != "" && i > 0 && g.pods[i-1].disk == "") {
+			x = 10
+			y += 150
+		}
+		p.x, p.y = x, y
+		x += p.dx + 30
+	}
+	return g
+}
+
+// importedFlag is a host-port flag of src that points at port on dst.
+type importedFlag struct {
+	src, dst *importedNode
+	flag     string
+	port     ServicePort
+}
+
+// hostPortFlag returns the flag that arg stands for, if it's a --flag=host:port
+// where host:port is a port on one of the services in addrs.
+func hostPortFlag(arg string, addrs map[string]*Service, byService map[*Service]*importedNode) (fe importedFlag, ok bool) {
+	m := flagArgRe.FindStringSubmatch(arg)
+	if m == nil {
+		return fe, false
+	}
+	host, portStr, err := net.SplitHostPort(m[2])
+	if err != nil {
+		return fe, false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fe, false
+	}
+	s, found := addrs[host]
+	if !found {
+		return fe, false
+	}
+	for _, sp := range s.Spec.Ports {
+		if sp.Port == port {
+			fe.dst = byService[s]
+			fe.flag = m[1]
+			fe.port = sp
+			return fe, true
+		}
+	}
+	return fe, false
+}
+
+// servicePortTarget returns the container port that sp routes to, looking up
+// a named target port in ports.  It returns 0 if the name isn't there.
+func servicePortTarget(sp ServicePort, ports []ContainerPort) int {
+	if sp.TargetPort.StrVal != "" {
+		for _, cp := range ports {
+			if cp.Name == sp.TargetPort.StrVal {
+				return cp.ContainerPort
+			}
+		}
+		return 0
+	}
+	if sp.TargetPort.IntVal != 0 {
+		return sp.TargetPort.IntVal
+	}
+	return sp.Port
+}
+
+// containerPorts returns the ports of the container that flow imports n as,
+// which a named target port on n's service refers to.
+func (n *importedNode) containerPorts() []ContainerPort {
+	if n.rc == nil {
+		return nil
+	}
+	return n.rc.Spec.Template.Spec.Containers[0].Ports
+}
+
+// selects returns true if selector is non-empty and matches labels.
+func selects(selector, labels map[string]string) bool {
+	if len(selector) == 0 {
+		return false
+	}
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// sameLabels returns true if a and b hold the same labels.
+func sameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeLabels returns the labels in a overridden by those in b.
+func mergeLabels(a, b map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		merged[k] = v
+	}
+	return merged
+}
+
+// findAnchor returns the first anchor of p whose object matches.
+func findAnchor(p *pod, match func(obj interface{}) bool) *podAnchor {
+	for _, anch := range p.anchors {
+		if match(anch.obj) {
+			return anch
+		}
+	}
+	return nil
+}
+
+// addImported adds g to the workspace.  Nodes that were already imported, and
+// disks that are already in the workspace, are reused rather than added again.
+func (ws *workspaceState) addImported(g *importedGraph) {
+	existing := make(map[string]*pod)
+	key := func(p *pod) string {
+		if p.disk != "" {
+			return "disk/" + p.disk
+		}
+		if p.imported != nil {
+			return ws.namespaceOf(p) + "/" + p.manifest.Name.String()
+		}
+		return ""
+	}
+	for _, p := range ws.pods {
+		if k := key(p); k != "" {
+			existing[k] = p
+		}
+	}
+	replaced := make(map[*pod]*pod)
+	added := 0
+	for _, p := range g.pods {
+		if old, ok := existing[key(p)]; ok {
+			replaced[p] = old
+			continue
+		}
+		ws.pods = append(ws.pods, p)
+		if p.manifest != nil {
+			added++
+		}
+	}
+	// Anchors are made in the same order for the same objects, so an anchor of
+	// a replaced node has the same index on the node that replaced it.
+	reuse := func(anch *podAnchor) *podAnchor {
+		old, ok := replaced[anch.pod]
+		if !ok {
+			return anch
+		}
+		for i := range anch.pod.anchors {
+			if anch.pod.anchors[i] == anch && i < len(old.anchors) {
+				return old.anchors[i]
+			}
+		}
+		return nil
+	}
+	for _, e := range g.edges {
+		if replaced[e.src.pod] != nil && replaced[e.dst.pod] != nil {
+			continue
+		}
+		e.src, e.dst = reuse(e.src), reuse(e.dst)
+		if e.src != nil && e.dst != nil {
+			ws.edges = append(ws.edges, e)
+		}
+	}
+
+	msg := fmt.Sprintf("Imported %d nodes from %s on %s", added, g.namespace, ws.clusterName())
+	if len(g.skipped) > 0 {
+		SetToast("toaster", ToastWarning, fmt.Sprintf("%s, skipped %s", msg, strings.Join(g.skipped, ", ")))
+		return
+	}
+	SetToast("toaster", ToastSuccess, msg)
+}
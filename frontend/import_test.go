@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Objects as kubectl returns them for things that flow didn't deploy, with a
+// named target port and resource quantities.
+const (
+	importedServiceJSON = `{
+  "apiVersion": "v1",
+  "kind": "Service",
+  "metadata": {"name": "web", "namespace": "default"},
+  "spec": {
+    "selector": {"app": "web"},
+    "ports": [
+      {"name": "http", "port": 80, "protocol": "TCP", "targetPort": "http"},
+      {"name": "admin", "port": 9000, "protocol": "TCP", "targetPort": 9001},
+      {"name": "debug", "port": 6060, "protocol": "TCP", "targetPort": "pprof"}
+    ]
+  }
+}`
+	importedRCJSON = `{
+  "apiVersion": "v1",
+  "kind": "ReplicationController",
+  "metadata": {"name": "web", "namespace": "default"},
+  "spec": {
+    "replicas": 2,
+    "selector": {"app": "web"},
+    "template": {
+      "metadata": {"labels": {"app": "web"}},
+      "spec": {
+        "containers": [{
+          "name": "web",
+          "image": "example.com/web:1.0",
+          "ports": [{"name": "http", "containerPort": 8080, "protocol": "TCP"}],
+          "resources": {
+            "limits": {"cpu": "500m", "memory": "128Mi"},
+            "requests": {"cpu": 0.1, "memory": "64Mi"}
+          }
+        }]
+      }
+    }
+  }
+}`
+)
+
+func TestImportDecodesNamedPortsAndQuantities(t *testing.T) {
+	var s Service
+	if err := json.Unmarshal([]byte(importedServiceJSON), &s); err != nil {
+		t.Fatalf("unable to decode service: %v", err)
+	}
+	var rc ReplicationController
+	if err := json.Unmarshal([]byte(importedRCJSON), &rc); err != nil {
+		t.Fatalf("unable to decode replication controller: %v", err)
+	}
+	resources := rc.Spec.Template.Spec.Containers[0].Resources
+	if got := resources.Limits[ResourceMemory]; got != "128Mi" {
+		t.Errorf("memory limit = %q, want 128Mi", got)
+	}
+	if got := resources.Requests[ResourceCPU]; got != "0.1" {
+		t.Errorf("cpu request = %q, want 0.1", got)
+	}
+
+	n := &importedNode{rc: &rc, service: &s}
+	for i, want := range []int{8080, 9001, 0} {
+		if got := servicePortTarget(s.Spec.Ports[i], n.containerPorts()); got != want {
+			t.Errorf("target of %s = %d, want %d", s.Spec.Ports[i].Name, got, want)
+		}
+	}
+	if got := servicePortTarget(ServicePort{Port: 80}, nil); got != 80 {
+		t.Errorf("target of a port without a target port = %d, want 80", got)
+	}
+}
+
+func TestIntOrStringRoundTrips(t *testing.T) {
+	for _, data := range []string{`8080`, `"http"`} {
+		var is IntOrString
+		if err := json.Unmarshal([]byte(data), &is); err != nil {
+			t.Fatalf("unable to decode %s: %v", data, err)
+		}
+		out, err := json.Marshal(is)
+		if err != nil {
+			t.Fatalf("unable to encode %+v: %v", is, err)
+		}
+		if string(out) != data {
+			t.Errorf("%s round trips to %s", data, out)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api/unversioned"
+)
+
+// ingressType is how an ingress node exposes the ports it is connected to.
+type ingressType string
+
+const (
+	ingressLoadBalancer ingressType = "LoadBalancer"
+	ingressNodePort     ingressType = "NodePort"
+	ingressClusterIP    ingressType = "ClusterIP"
+	ingressHTTP         ingressType = "HTTP"
+)
+
+// ingressName returns the name of the Ingress object that the workspace's HTTP
+// ingress nodes in a namespace are merged into.  It's named after the workspace
+// so that workspaces sharing a namespace don't replace each other's routes.
+func ingressName() string {
+	id := strings.ToLower(strings.Replace(workspaceID, "_", "-", -1))
+	return strings.Trim("flow-ingress-"+id, "-.")
+}
+
+// portObj is the anchor object of an ingress node.  HTTP ingresses route
+// host/path to whatever they're connected to, every other type exposes port
+// on the connected container's Service.
+type portObj struct {
+	typ      ingressType
+	port     int
+	nodePort int
+	host     string
+	path     string
+}
+
+func (po *portObj) String() string {
+	switch po.typ {
+	case ingressHTTP:
+		return fmt.Sprintf("http %s%s", po.host, po.path)
+	case ingressNodePort:
+		if po.nodePort != 0 {
+			return fmt.Sprintf("nodeport %d:%d", po.port, po.nodePort)
+		}
+		return fmt.Sprintf("nodeport %d", po.port)
+	case ingressClusterIP:
+		return fmt.Sprintf("cluster %d", po.port)
+	}
+	return fmt.Sprintf("port %d", po.port)
+}
+
+// serviceType is the Service type needed to expose this ingress, or the empty
+// string if it has no effect on the Service.
+func (po *portObj) serviceType() ServiceType {
+	switch po.typ {
+	case ingressLoadBalancer:
+		return ServiceTypeLoadBalancer
+	case ingressNodePort:
+		return ServiceTypeNodePort
+	case ingressClusterIP:
+		return ServiceTypeClusterIP
+	}
+	return ""
+}
+
+// serviceTypeRank orders Service types so that the most exposed type wins when
+// more than one ingress is connected to the same Service.
+var serviceTypeRank = map[ServiceType]int{
+	"":                      0,
+	ServiceTypeClusterIP:    1,
+	ServiceTypeNodePort:     2,
+	ServiceTypeLoadBalancer: 3,
+}
+
+// parseIngress parses the spec for an ingress node of type typ.  HTTP ingresses
+// take [host]/path, NodePort ingresses take port[:nodePort], and everything else
+// takes a port.
+func parseIngress(typ ingressType, spec string) (*portObj, error) {
+	spec = strings.TrimSpace(spec)
+	po := &portObj{typ: typ}
+	switch typ {
+	case ingressHTTP:
+		slash := strings.Index(spec, "/")
+		if slash == -1 {
+			po.host = spec
+			po.path = "/"
+		} else {
+			po.host = spec[0:slash]
+			po.path = spec[slash:]
+		}
+		return po, nil
+
+	case ingressNodePort:
+		if colon := strings.Index(spec, ":"); colon != -1 {
+			n, err := strconv.ParseInt(spec[colon+1:], 10, 32)
+			if err != nil || n < 30000 || n > 32767 {
+				return nil, fmt.Errorf("node port must be in the range 30000-32767, got %q", spec[colon+1:])
+			}
+			po.nodePort = int(n)
+			spec = spec[0:colon]
+		}
+
+	case ingressLoadBalancer, ingressClusterIP:
+
+	default:
+		return nil, fmt.Errorf("unknown ingress type %q", typ)
+	}
+	n, err := strconv.ParseInt(spec, 10, 32)
+	if err != nil || n <= 0 || n > 65535 {
+		return nil, fmt.Errorf("unable to parse %q as a port", spec)
+	}
+	po.port = int(n)
+	return po, nil
+}
+
+// createIngressObjects merges the HTTP ingress nodes into one Ingress for each
+// namespace that they route to, since an Ingress can only route to services in
+// its own namespace.
+func (ws *workspaceState) createIngressObjects() ([]*Ingress, error) {
+	paths := make(map[string]map[string][]HTTPIngressPath)
+	seen := make(map[string]bool)
+	for _, e := range ws.edges {
+		if !e.complete {
+			continue
+		}
+		po, ok := e.src.obj.(*portObj)
+		if !ok || po.typ != ingressHTTP {
+			continue
+		}
+		if e.dst.pod.manifest == nil {
+			return nil, fmt.Errorf("http ingress %s is not connected to a container", po)
+		}
+		ns := ws.namespaceOf(e.dst.pod)
+		route := ns + ":" + po.host + po.path
+		if seen[route] {
+			return nil, fmt.Errorf("more than one port is routed from %s", route)
+		}
+		seen[route] = true
+		port, err := ws.servicePortFor(e)
+		if err != nil {
+			return nil, err
+		}
+		if paths[ns] == nil {
+			paths[ns] = make(map[string][]HTTPIngressPath)
+		}
+		paths[ns][po.host] = append(paths[ns][po.host], HTTPIngressPath{
+			Path: po.path,
+			Backend: IngressBackend{
+				ServiceName: ws.serviceName(e.dst.pod),
+				ServicePort: port,
+			},
+		})
+	}
+
+	var namespaces []string
+	for ns := range paths {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	var ingresses []*Ingress
+	for _, ns := range namespaces {
+		var hosts []string
+		for host := range paths[ns] {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		ingress := &Ingress{
+			TypeMeta: unversioned.TypeMeta{
+				APIVersion: "extensions/v1beta1",
+				Kind:       "Ingress",
+			},
+			ObjectMeta: ObjectMeta{
+				Labels:    objectLabels(ingressName()),
+				Name:      ingressName(),
+				Namespace: ns,
+			},
+		}
+		for _, host := range hosts {
+			ingress.Spec.Rules = append(ingress.Spec.Rules, IngressRule{
+				Host: host,
+				IngressRuleValue: IngressRuleValue{
+					HTTP: &HTTPIngressRuleValue{Paths: paths[ns][host]},
+				},
+			})
+		}
+		ingresses = append(ingresses, ingress)
+	}
+	return ingresses, nil
+}
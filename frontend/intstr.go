@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// IntOrString holds a value that the API accepts as either a number or a name,
+// such as a Service's target port, in the way that
+// k8s.io/kubernetes/pkg/util/intstr.IntOrString does.  It's a name if StrVal is
+// set.
+type IntOrString struct {
+	IntVal int
+	StrVal string
+}
+
+func (is IntOrString) String() string {
+	if is.StrVal != "" {
+		return is.StrVal
+	}
+	return strconv.Itoa(is.IntVal)
+}
+
+func (is IntOrString) MarshalJSON() ([]byte, error) {
+	if is.StrVal != "" {
+		return json.Marshal(is.StrVal)
+	}
+	return json.Marshal(is.IntVal)
+}
+
+func (is *IntOrString) UnmarshalJSON(data []byte) error {
+	*is = IntOrString{}
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &is.StrVal)
+	}
+	return json.Unmarshal(data, &is.IntVal)
+}
+
+// Quantity is an amount of a resource, like "100m" or "128Mi", as in
+// k8s.io/kubernetes/pkg/api/resource.Quantity.  Flow never does arithmetic on
+// quantities so they're kept as the API wrote them.
+type Quantity string
+
+func (q *Quantity) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		*q = Quantity(v)
+	case float64:
+		*q = Quantity(strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		return fmt.Errorf("invalid quantity %s", data)
+	}
+	return nil
+}
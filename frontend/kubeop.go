@@ -0,0 +1,21 @@
+package main
+
+// kubeOp is a kubectl operation for the server to run on one of its clusters.
+// The server only allows create, apply, get, delete, scale, logs, exec and
+// port-forward on the kinds of object that flow manages, and builds the
+// command line itself.
+type kubeOp struct {
+	Op        string            `json:"op"`
+	Cluster   string            `json:"cluster,omitempty"`
+	Kind      string            `json:"kind,omitempty"`
+	Name      string            `json:"name,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	Selector  map[string]string `json:"selector,omitempty"`
+	Replicas  *int              `json:"replicas,omitempty"`
+	Container string            `json:"container,omitempty"`
+	Previous  bool              `json:"previous,omitempty"`
+	TailLines int               `json:"tailLines,omitempty"`
+
+	// RemotePort is the pod's port to forward to, for port-forward.
+	RemotePort int `json:"remotePort,omitempty"`
+}
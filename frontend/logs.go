@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// maxLogText is how much of a followed log the pane keeps.
+const maxLogText = 1 << 20
+
+// logTarget is the pods whose logs the log pane shows.
+type logTarget struct {
+	title     string
+	cluster   string
+	namespace string
+	selector  map[string]string
+	container string
+}
+
+// logPane shows logs streamed from the server's /logs/ endpoint.
+type logPane struct {
+	doc    *js.Object
+	target logTarget
+
+	// req is the request currently streaming into the pane, if any.
+	req *js.Object
+}
+
+var logs logPane
+
+// setupLogPane wires up the log pane's controls.
+func setupLogPane(doc *js.Object) {
+	logs.doc = doc
+	reload := js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		logs.load()
+		return nil
+	})
+	doc.Call("getElementById", "log-reload").Call("addEventListener", "click", reload, false)
+	for _, id := range []string{"log-previous", "log-follow", "log-timestamps"} {
+		doc.Call("getElementById", id).Call("addEventListener", "change", reload, false)
+	}
+	doc.Call("getElementById", "log-close").Call("addEventListener", "click", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		logs.close()
+		return nil
+	}), false)
+}
+
+// show opens the log pane on the logs of t.
+func (lp *logPane) show(t logTarget) {
+	lp.target = t
+	lp.doc.Call("getElementById", "log-title").Set("textContent", fmt.Sprintf("Logs of %s in %s ", t.title, t.namespace))
+	lp.doc.Call("getElementById", "log-container").Set("value", t.container)
+	lp.doc.Call("getElementById", "log-pane").Get("style").Set("display", "block")
+	lp.load()
+}
+
+func (lp *logPane) close() {
+	lp.stop()
+	lp.doc.Call("getElementById", "log-pane").Get("style").Set("display", "none")
+}
+
+func (lp *logPane) stop() {
+	if lp.req != nil {
+		lp.req.Call("abort")
+		lp.req = nil
+	}
+}
+
+// query returns the /logs/ query for the target and the pane's settings.
+func (lp *logPane) query() (url.Values, error) {
+	get := func(id string) *js.Object {
+		return lp.doc.Call("getElementById", id)
+	}
+	var sel []string
+	for k, v := range lp.target.selector {
+		sel = append(sel, k+"="+v)
+	}
+	q := url.Values{}
+	q.Set("cluster", lp.target.cluster)
+	q.Set("namespace", lp.target.namespace)
+	q.Set("selector", strings.Join(sel, ","))
+	if container := strings.TrimSpace(get("log-container").Get("value").String()); container != "" {
+		q.Set("container", container)
+	}
+	if tail := strings.TrimSpace(get("log-tail").Get("value").String()); tail != "" {
+		if n, err := strconv.Atoi(tail); err != nil || n < 0 {
+			return nil, fmt.Errorf("unable to parse %q as a number of lines", tail)
+		}
+		q.Set("tailLines", tail)
+	}
+	q.Set("previous", strconv.FormatBool(get("log-previous").Get("checked").Bool()))
+	q.Set("follow", strconv.FormatBool(get("log-follow").Get("checked").Bool()))
+	q.Set("timestamps", strconv.FormatBool(get("log-timestamps").Get("checked").Bool()))
+	return q, nil
+}
+
+// load (re)starts streaming logs into the pane.  The response is read as it
+// arrives so that followed logs show up live, and only the last maxLogText of
+// it is kept.
+func (lp *logPane) load() {
+	lp.stop()
+	output := lp.doc.Call("getElementById", "log-output")
+	output.Set("textContent", "")
+	q, err := lp.query()
+	if err != nil {
+		SetToast("toaster", ToastError, err.Error())
+		return
+	}
+	var req *js.Object
+	text := ""
+	req = streamGet("/logs/?"+q.Encode(), func(data string) {
+		if lp.req != req {
+			return
+		}
+		text = trimText(text+data, maxLogText)
+		atBottom := output.Get("scrollTop").Int()+output.Get("clientHeight").Int() >= output.Get("scrollHeight").Int()-10
+		output.Set("textContent", text)
+		if atBottom {
+			output.Set("scrollTop", output.Get("scrollHeight"))
+		}
+	}, func(status int, body string) {
+		if lp.req != req {
+			return
+		}
+		lp.req = nil
+		if status != 200 {
+			SetToast("toaster", ToastError, fmt.Sprintf("Unable to get logs: %s", body))
+		}
+	})
+	lp.req = req
+}
+
+// trimText returns at most the last max bytes of text, starting at a whole
+// character.
+func trimText(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	text = text[len(text)-max:]
+	for len(text) > 0 && !utf8.RuneStart(text[0]) {
+		text = text[1:]
+	}
+	return text
+}
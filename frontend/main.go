@@ -15,6 +15,53 @@ import (
 	"github.com/gopherjs/gopherjs/js"
 )
 
+// containerInfo is what the server responds with when asked for a container.
+type containerInfo struct {
+	Manifest  schema.ImageManifest `json:"manifest"`
+	Signature signatureInfo        `json:"signature"`
+	Image     string               `json:"image"`
+	Layers    []layerInfo          `json:"layers,omitempty"`
+
+	// If set, Undeployable is why the cluster can't run the image.
+	Undeployable string `json:"undeployable,omitempty"`
+
+	// If set, at is where on the canvas the image was dropped.
+	at *point
+
+	// source is the name the image was asked for by, and platform is what it
+	// was discovered for.
+	source   string
+	platform platform
+}
+
+// layerInfo describes one image in the dependency tree of a container.
+type layerInfo struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	ImageID   string            `json:"imageID,omitempty"`
+	Parent    string            `json:"parent,omitempty"`
+	Depth     int               `json:"depth"`
+	Signature *signatureInfo    `json:"signature,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// signatureInfo describes whether the server was able to verify an image.
+type signatureInfo struct {
+	Status  string `json:"status"`
+	Signer  string `json:"signer,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func (si signatureInfo) verified() bool {
+	return si.Status == "verified"
+}
+
+// pending is true while the server is still downloading the image, and so
+// hasn't checked its signature yet.
+func (si signatureInfo) pending() bool {
+	return si.Status == "pending"
+}
+
 var lastToastMu sync.Mutex
 var lastToast time.Time
 
@@ -66,6 +113,60 @@ func SetToast(id string, severity ToastSeverity, msg string) {
 	}()
 }
 
+// fetchImage asks the server for the image called name, built for pl.  Any
+// problems with the image that don't stop it from being used are toasted.
+func fetchImage(name string, pl platform) (*containerInfo, error) {
+	resp, err := http.Get("/container/" + name + pl.query())
+	if err != nil {
+		return nil, fmt.Errorf("unable to contact server: %v", err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse response from server: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to find container: %s", data)
+	}
+	var info containerInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("unable to parse response from server: %v", err)
+	}
+	if !info.Signature.verified() && !info.Signature.pending() {
+		SetToast("toaster", ToastWarning, fmt.Sprintf("Image %s is %s: %s", info.Manifest.Name, info.Signature.Status, info.Signature.Message))
+	}
+	for _, layer := range info.Layers {
+		if layer.Error != "" {
+			SetToast("toaster", ToastWarning, fmt.Sprintf("Dependency %s of %s: %s", layer.Name, layer.Parent, layer.Error))
+			break
+		}
+	}
+	info.source = name
+	info.platform = pl
+	return &info, nil
+}
+
+// addImage asks the server for the image called name and adds it to the
+// workspace, at the given point if there is one.
+func addImage(w *Workspace, name string, at *point) {
+	info, err := fetchImage(name, currentPlatform())
+	if err != nil {
+		SetToast("toaster", ToastError, err.Error())
+		return
+	}
+	info.at = at
+	w.Images() <- *info
+}
+
+// currentPlatform returns the workspace's default platform.
+func currentPlatform() platform {
+	sel := js.Global.Get("document").Call("getElementById", "platform")
+	pl, err := parsePlatform(sel.Get("value").String())
+	if err != nil {
+		return defaultPlatform
+	}
+	return pl
+}
+
 func main() {
 	doc := js.Global.Get("document")
 	canvas := doc.Call("getElementById", "workspace-canvas")
@@ -86,28 +187,18 @@ func main() {
 	addContainer := doc.Call("getElementById", "add-container")
 	containerName := doc.Call("getElementById", "container-name")
 	addContainer.Call("addEventListener", "click", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
-		go func() {
-			resp, err := http.Get("/container/" + containerName.Get("value").String())
-			if err != nil {
-				SetToast("toaster", ToastError, fmt.Sprintf("Unable to contact server: %v", err))
-				return
-			}
-			data, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				SetToast("toaster", ToastError, fmt.Sprintf("Unable to parse response from server: %v", err))
-				return
-			}
-			var manifest schema.ImageManifest
-			if err := json.Unmarshal(data, &manifest); err != nil {
-				SetToast("toaster", ToastError, fmt.Sprintf("Unable to parse response from server: %v", err))
-				return
-			}
-			w.Images() <- manifest
-		}()
+		go addImage(w, containerName.Get("value").String(), nil)
 		return nil
 	}), false)
 	addContainer.Set("disabled", nil)
 
+	setupWorkspaceID(w)
+	setupPalette(w, containerName)
+	setupClusters(w)
+	setupLogPane(doc)
+	setupTerminal(doc)
+	setupPortForwards()
+
 	addDisk := doc.Call("getElementById", "add-disk")
 	addDisk.Call("addEventListener", "click", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
 		name := containerName.Get("value").String()
@@ -122,19 +213,63 @@ func main() {
 	addDisk.Set("disabled", nil)
 
 	addIngress := doc.Call("getElementById", "add-ingress")
+	ingressKind := doc.Call("getElementById", "ingress-type")
 	addIngress.Call("addEventListener", "click", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		po, err := parseIngress(ingressType(ingressKind.Get("value").String()), containerName.Get("value").String())
+		if err != nil {
+			SetToast("toaster", ToastError, err.Error())
+			return nil
+		}
+		go func() {
+			w.Ingresses() <- po
+		}()
+		return nil
+	}), false)
+	addIngress.Set("disabled", nil)
+
+	addExternal := doc.Call("getElementById", "add-external")
+	addExternal.Call("addEventListener", "click", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		eo, ns, err := parseExternal(containerName.Get("value").String())
+		if err != nil {
+			SetToast("toaster", ToastError, err.Error())
+			return nil
+		}
+		go func() {
+			w.Externals() <- externalNode{obj: eo, namespace: ns}
+		}()
+		return nil
+	}), false)
+	addExternal.Set("disabled", nil)
+
+	pinPort := doc.Call("getElementById", "pin-port")
+	pinPort.Call("addEventListener", "click", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
 		str := containerName.Get("value").String()
 		n, err := strconv.ParseInt(str, 10, 32)
-		if err != nil || n <= 0 {
-			SetToast("toaster", ToastError, fmt.Sprintf("Unable to parse %q as a positive integer", str))
+		if err != nil || n < 0 {
+			SetToast("toaster", ToastError, fmt.Sprintf("Unable to parse %q as a port, use 0 to unpin", str))
 			return nil
 		}
 		go func() {
-			w.Ingresses() <- int(n)
+			w.PinPorts() <- int(n)
 		}()
 		return nil
 	}), false)
-	addIngress.Set("disabled", nil)
+	pinPort.Set("disabled", nil)
+
+	namespace := doc.Call("getElementById", "namespace")
+	createNamespace := doc.Call("getElementById", "create-namespace")
+	namespaceChanged := js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		ns := namespaceSetting{
+			name:   namespace.Get("value").String(),
+			create: createNamespace.Get("checked").Bool(),
+		}
+		go func() {
+			w.Namespaces() <- ns
+		}()
+		return nil
+	})
+	namespace.Call("addEventListener", "change", namespaceChanged, false)
+	createNamespace.Call("addEventListener", "change", namespaceChanged, false)
 
 	makeItSo := doc.Call("getElementById", "make-it-so")
 	makeItSo.Call("addEventListener", "click", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
@@ -144,4 +279,30 @@ func main() {
 		return nil
 	}), false)
 	makeItSo.Set("disabled", nil)
+
+	importButton := doc.Call("getElementById", "import")
+	importButton.Call("addEventListener", "click", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		ns := js.Global.Get("window").Call("prompt", "Namespace to import services and replication controllers from, leave empty to use the workspace's namespace", namespace.Get("value"))
+		if ns == nil {
+			return nil
+		}
+		w.Import(ns.String())
+		return nil
+	}), false)
+	importButton.Set("disabled", nil)
+
+	tearDown := doc.Call("getElementById", "tear-down")
+	keepData := doc.Call("getElementById", "keep-data")
+	tearDown.Call("addEventListener", "click", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		msg := "Delete everything this workspace deployed, including the namespaces it created?  Persistent volume claims are deleted along with those namespaces, and never otherwise."
+		if keepData.Get("checked").Bool() {
+			msg = "Delete everything this workspace deployed, keeping the namespaces it created?  Persistent volume claims are only ever deleted along with a namespace, so they're all kept."
+		}
+		if !js.Global.Get("window").Call("confirm", msg).Bool() {
+			return nil
+		}
+		w.TearDown(keepData.Get("checked").Bool())
+		return nil
+	}), false)
+	tearDown.Set("disabled", nil)
 }
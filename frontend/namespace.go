@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/kubernetes/pkg/api/unversioned"
+)
+
+// clusterDomain is the DNS domain of the cluster, used when a service has to be
+// addressed from another namespace.
+const clusterDomain = "cluster.local"
+
+// namespaceSetting is the workspace-wide namespace configuration.
+type namespaceSetting struct {
+	name string
+
+	// If create is set then namespaces that don't exist are created before
+	// anything is deployed into them.
+	create bool
+}
+
+// nodeNamespace overrides the namespace of a single node.
+type nodeNamespace struct {
+	pod  *pod
+	name string
+}
+
+// namespaceOf returns the namespace that p is deployed into.
+func (ws *workspaceState) namespaceOf(p *pod) string {
+	if p.namespace != "" {
+		return p.namespace
+	}
+	if ws.namespace.name != "" {
+		return ws.namespace.name
+	}
+	if ws.cluster.Namespace != "" {
+		return ws.cluster.Namespace
+	}
+	return NamespaceDefault
+}
+
+// namespacesInUse returns, in sorted order, every namespace that something in
+// the workspace is deployed into.
+func (ws *workspaceState) namespacesInUse() []string {
+	seen := make(map[string]bool)
+	var namespaces []string
+	for _, p := range ws.pods {
+		if p.manifest == nil && (p.ext == nil || p.ext.publish == "") {
+			continue
+		}
+		ns := ws.namespaceOf(p)
+		if !seen[ns] {
+			seen[ns] = true
+			namespaces = append(namespaces, ns)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// ensureNamespaces makes sure that every namespace in use exists, creating them
+// if the workspace is configured to do so.
+func (ws *workspaceState) ensureNamespaces() error {
+	for _, ns := range ws.namespacesInUse() {
+		var existing Namespace
+		err := ws.kubectlGet("", "namespace", ns, &existing)
+		if err == nil {
+			continue
+		}
+		if !isNotFound(err) {
+			return fmt.Errorf("unable to get namespace %s: %v", ns, err)
+		}
+		if !ws.namespace.create {
+			return fmt.Errorf("namespace %s does not exist", ns)
+		}
+		if err := ws.createObject(&Namespace{
+			TypeMeta: unversioned.TypeMeta{
+				APIVersion: "v1",
+				Kind:       "Namespace",
+			},
+			ObjectMeta: ObjectMeta{
+				Labels: objectLabels(ns),
+				Name:   ns,
+			},
+		}); err != nil {
+			return fmt.Errorf("failed to create namespace %s: %v", ns, err)
+		}
+	}
+	return nil
+}
+
+// serviceHost returns the host that the source of e should use to reach the
+// service at the destination of e.  Services in the same namespace are reached
+// by their cluster IP, services in other namespaces by their DNS name.
+func (ws *workspaceState) serviceHost(e *edge) (string, error) {
+	name := ws.serviceName(e.dst.pod)
+	ns := ws.namespaceOf(e.dst.pod)
+	if ns != ws.namespaceOf(e.src.pod) {
+		return fmt.Sprintf("%s.%s.svc.%s", name, ns, clusterDomain), nil
+	}
+	s, err := ws.getService(ns, name)
+	if err != nil {
+		return "", fmt.Errorf("unable to get service %q: %v", name, err)
+	}
+	return s.Spec.ClusterIP, nil
+}
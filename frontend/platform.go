@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// defaultPlatform is used until the workspace is told otherwise.
+var defaultPlatform = platform{os: "linux", arch: "amd64"}
+
+// kubeArch maps appc arch labels to the names kubernetes uses for node labels
+// where they differ.
+var kubeArch = map[string]string{
+	"aarch64": "arm64",
+	"armv7l":  "arm",
+	"i386":    "386",
+}
+
+// platform is the os and arch, as appc labels, that an image is discovered for
+// and that its pods are scheduled onto.
+type platform struct {
+	os   string
+	arch string
+}
+
+func (pl platform) String() string {
+	return pl.os + "/" + pl.arch
+}
+
+// parsePlatform parses os/arch, e.g. linux/aarch64.
+func parsePlatform(str string) (platform, error) {
+	parts := strings.Split(strings.TrimSpace(str), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return platform{}, fmt.Errorf("%q is not of the form os/arch", str)
+	}
+	return platform{os: parts[0], arch: parts[1]}, nil
+}
+
+// query returns the query string that asks the server for an image for pl.
+func (pl platform) query() string {
+	v := url.Values{}
+	v.Set("os", pl.os)
+	v.Set("arch", pl.arch)
+	return "?" + v.Encode()
+}
+
+// nodeSelector returns the node labels that pods for pl must be scheduled on.
+func (pl platform) nodeSelector() map[string]string {
+	if pl.os == "" || pl.arch == "" {
+		return nil
+	}
+	arch := pl.arch
+	if a, ok := kubeArch[arch]; ok {
+		arch = a
+	}
+	return map[string]string{
+		"beta.kubernetes.io/os":   pl.os,
+		"beta.kubernetes.io/arch": arch,
+	}
+}
+
+// nodePlatform changes the platform of a single node, along with the image
+// that was discovered for it.
+type nodePlatform struct {
+	pod      *pod
+	platform platform
+	info     *containerInfo
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// portForward is a port-forward session that the server is running for us, see
+// /portforward/.  LocalPort is on the flow server's loopback interface, so it
+// can only be reached from the flow server itself, and by anything there.
+type portForward struct {
+	ID         string            `json:"id"`
+	Cluster    string            `json:"cluster"`
+	Namespace  string            `json:"namespace"`
+	Pod        string            `json:"pod"`
+	RemotePort int               `json:"remotePort"`
+	LocalPort  int               `json:"localPort"`
+	Selector   map[string]string `json:"selector"`
+}
+
+// address is where the session is on the flow server.
+func (pf *portForward) address() string {
+	return fmt.Sprintf("localhost:%d on %s", pf.LocalPort, serverHost())
+}
+
+// sshCommand tunnels the session to the same port on the user's machine.
+func (pf *portForward) sshCommand() string {
+	return fmt.Sprintf("ssh -N -L %d:localhost:%d %s", pf.LocalPort, pf.LocalPort, serverHost())
+}
+
+// serverHost is the flow server's host name, as the browser knows it.
+func serverHost() string {
+	return js.Global.Get("location").Get("hostname").String()
+}
+
+// forwards are our sessions as of the last time they were started, stopped or
+// listed.
+var forwards []portForward
+
+// setupPortForwards picks up the sessions left running from earlier visits.
+func setupPortForwards() {
+	go func() {
+		if err := loadPortForwards(); err != nil {
+			SetToast("toaster", ToastError, err.Error())
+		}
+	}()
+}
+
+func loadPortForwards() error {
+	resp, err := http.Get("/portforward/")
+	if err != nil {
+		return fmt.Errorf("unable to contact server: %v", err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read port-forwards: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to load port-forwards: %s", data)
+	}
+	var pfs []portForward
+	if err := json.Unmarshal(data, &pfs); err != nil {
+		return fmt.Errorf("unable to parse port-forwards: %v", err)
+	}
+	forwards = pfs
+	return nil
+}
+
+// startPortForward asks the server to forward a free port to op's pod.
+func startPortForward(op kubeOp) (portForward, error) {
+	op.Op = "port-forward"
+	data, err := json.Marshal(op)
+	if err != nil {
+		return portForward{}, fmt.Errorf("unable to marshal operation: %v", err)
+	}
+	resp, err := http.Post("/portforward/", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return portForward{}, fmt.Errorf("unable to contact server: %v", err)
+	}
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return portForward{}, fmt.Errorf("unable to read port-forward: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return portForward{}, fmt.Errorf("unable to forward port %d: %s", op.RemotePort, data)
+	}
+	var pf portForward
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return portForward{}, fmt.Errorf("unable to parse port-forward: %v", err)
+	}
+	forwards = append(forwards, pf)
+	return pf, nil
+}
+
+func stopPortForward(id string) error {
+	req, _ := http.NewRequest("DELETE", "/portforward/"+id, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to contact server: %v", err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unable to stop port-forward: %s", data)
+	}
+	for i := range forwards {
+		if forwards[i].ID == id {
+			forwards = append(forwards[:i], forwards[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// streamGet fetches url and hands its body to chunk piece by piece as it
+// arrives, so that neither the browser nor the caller has to hold on to what's
+// already been read.  done is called once the body ends, or the request fails,
+// with the status and, unless the status is 200, the body, which isn't handed
+// to chunk.  A failed request has status 0.  The returned AbortController
+// cancels the request, after which neither is called again.
+func streamGet(url string, chunk func(data string), done func(status int, body string)) *js.Object {
+	controller := js.Global.Get("AbortController").New()
+	fail := func(err *js.Object) {
+		if err.Get("name").String() == "AbortError" {
+			return
+		}
+		done(0, fmt.Sprintf("%s", err))
+	}
+	opts := js.M{"signal": controller.Get("signal"), "credentials": "same-origin"}
+	js.Global.Call("fetch", url, opts).Call("then", func(resp *js.Object) {
+		status := resp.Get("status").Int()
+		reader := resp.Get("body").Call("getReader")
+		decoder := js.Global.Get("TextDecoder").New()
+		body := ""
+		var read func()
+		read = func() {
+			reader.Call("read").Call("then", func(result *js.Object) {
+				if result.Get("done").Bool() {
+					data := decoder.Call("decode").String()
+					if status != 200 {
+						done(status, body+data)
+						return
+					}
+					if data != "" {
+						chunk(data)
+					}
+					done(status, "")
+					return
+				}
+				data := decoder.Call("decode", result.Get("value"), js.M{"stream": true}).String()
+				if status != 200 {
+					body += data
+				} else if data != "" {
+					chunk(data)
+				}
+				read()
+			}, fail)
+		}
+		read()
+	}, fail)
+	return controller
+}
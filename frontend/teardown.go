@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// teardownStep deletes every object of the given kind that the workspace
+// created.
+type teardownStep struct {
+	desc string
+	kind string
+}
+
+// teardownSteps are run in order for each namespace.  Things that route traffic
+// go first so that nothing is sent to pods that are going away.  Flow never
+// creates persistent volume claims, so they're only deleted along with a
+// namespace that the workspace created.
+var teardownSteps = []teardownStep{
+	{desc: "ingresses", kind: "ingress"},
+	{desc: "services", kind: "services"},
+	{desc: "endpoints", kind: "endpoints"},
+	{desc: "replication controllers", kind: "replicationcontrollers"},
+}
+
+// The local storage keys that the workspace id, and the namespaces that each
+// workspace has deployed into on each cluster, are kept under.  They outlive
+// the tab so that Tear Down still finds everything that was deployed before it
+// was closed.
+const (
+	workspaceIDKey        = "flow-workspace-id"
+	deployedNamespacesKey = "flow-deployed-namespaces"
+)
+
+// workspaceIDRe matches the values that a label, and so a workspace id, can
+// have.
+var workspaceIDRe = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?$`)
+
+// setupWorkspaceID picks up the workspace id that was last used, making one up
+// the first time, and lets it be changed so that what another workspace
+// deployed can be torn down.
+func setupWorkspaceID(w *Workspace) {
+	storage := js.Global.Get("localStorage")
+	if id := storage.Call("getItem", workspaceIDKey); id != nil {
+		workspaceID = id.String()
+	} else {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			SetToast("toaster", ToastError, fmt.Sprintf("Unable to make a workspace id: %v", err))
+		}
+		workspaceID = hex.EncodeToString(b)
+		storage.Call("setItem", workspaceIDKey, workspaceID)
+	}
+
+	input := js.Global.Get("document").Call("getElementById", "workspace-id")
+	input.Set("value", workspaceID)
+	input.Call("addEventListener", "change", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		id := strings.TrimSpace(input.Get("value").String())
+		if !workspaceIDRe.MatchString(id) {
+			SetToast("toaster", ToastError, fmt.Sprintf("Invalid workspace id %q, it has to be a valid label value", id))
+			return nil
+		}
+		storage.Call("setItem", workspaceIDKey, id)
+		w.SetWorkspaceID(id)
+		return nil
+	}), false)
+}
+
+// deployedNamespacesItem is the local storage key of the namespaces that the
+// workspace has deployed into on cluster.
+func deployedNamespacesItem(cluster string) string {
+	return deployedNamespacesKey + "/" + workspaceID + "/" + cluster
+}
+
+// deployedNamespaces returns every namespace that the workspace has deployed
+// into on cluster since it was last torn down there.
+func deployedNamespaces(cluster string) []string {
+	var namespaces []string
+	if data := js.Global.Get("localStorage").Call("getItem", deployedNamespacesItem(cluster)); data != nil {
+		json.Unmarshal([]byte(data.String()), &namespaces)
+	}
+	return namespaces
+}
+
+// rememberNamespaces adds namespaces to the deployedNamespaces of cluster.
+func rememberNamespaces(cluster string, namespaces []string) {
+	seen := make(map[string]bool)
+	var all []string
+	for _, ns := range append(deployedNamespaces(cluster), namespaces...) {
+		if !seen[ns] {
+			seen[ns] = true
+			all = append(all, ns)
+		}
+	}
+	sort.Strings(all)
+	data, err := json.Marshal(all)
+	if err != nil {
+		return
+	}
+	js.Global.Get("localStorage").Call("setItem", deployedNamespacesItem(cluster), string(data))
+}
+
+// tearDown deletes everything that the workspace created, in the namespaces it
+// uses or has deployed into.  Namespaces that it created are deleted too, which
+// deletes any persistent volume claims in them, unless keepData is set.
+func (ws *workspaceState) tearDown(keepData bool) error {
+	selector := map[string]string{workspaceLabel: workspaceID}
+	rememberNamespaces(ws.cluster.Name, ws.namespacesInUse())
+	namespaces := deployedNamespaces(ws.cluster.Name)
+
+	total := len(namespaces) * len(teardownSteps)
+	if !keepData {
+		total += len(namespaces)
+	}
+	done := 0
+	var failed []string
+	for _, ns := range namespaces {
+		for _, step := range teardownSteps {
+			done++
+			SetToast("toaster", ToastNone, fmt.Sprintf("Deleting %s in %s on %s (%d/%d)", step.desc, ns, ws.clusterName(), done, total))
+			out, err := ws.runKubeOp(kubeOp{Op: "delete", Kind: step.kind, Namespace: ns, Selector: selector})
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s in %s", step.desc, ns))
+				log.Printf("Failed to delete %s in %s: %v", step.desc, ns, err)
+				continue
+			}
+			log.Printf("%s", out)
+		}
+	}
+
+	// Namespaces are only deleted if this workspace created them, which
+	// deletes anything else that was left in them.
+	if !keepData {
+		for _, ns := range namespaces {
+			done++
+			SetToast("toaster", ToastNone, fmt.Sprintf("Deleting namespace %s on %s (%d/%d)", ns, ws.clusterName(), done, total))
+			var existing Namespace
+			if err := ws.kubectlGet("", "namespace", ns, &existing); err != nil {
+				continue
+			}
+			if existing.Labels[workspaceLabel] != workspaceID {
+				continue
+			}
+			if _, err := ws.runKubeOp(kubeOp{Op: "delete", Kind: "namespace", Name: ns}); err != nil {
+				failed = append(failed, fmt.Sprintf("namespace %s", ns))
+				log.Printf("Failed to delete namespace %s: %v", ns, err)
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to delete %s", strings.Join(failed, ", "))
+	}
+	js.Global.Get("localStorage").Call("removeItem", deployedNamespacesItem(ws.cluster.Name))
+	SetToast("toaster", ToastSuccess, fmt.Sprintf("Tore down everything in %s on %s", strings.Join(namespaces, ", "), ws.clusterName()))
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/gopherjs/gopherjs/js"
+)
+
+// The size of terminal that exec sessions are given.
+const (
+	terminalCols = 120
+	terminalRows = 30
+)
+
+// StreamTypeResize is sent to the server when the terminal changes size.
+const StreamTypeResize = "resize"
+
+// streamMessage is what's sent either way over an exec session, see /exec/.
+type streamMessage struct {
+	Stream string `json:"stream"`
+	Data   string `json:"data,omitempty"`
+	Cols   int    `json:"cols,omitempty"`
+	Rows   int    `json:"rows,omitempty"`
+}
+
+// execTarget is the pod, picked by selector, that the terminal runs a shell in.
+type execTarget struct {
+	title     string
+	cluster   string
+	namespace string
+	selector  map[string]string
+	container string
+}
+
+// terminalPane shows an interactive shell in a pod.  It understands just enough
+// of what a terminal is sent to be usable, escape sequences are dropped.
+type terminalPane struct {
+	doc *js.Object
+
+	// socket is the session currently attached to the pane, if any.
+	socket *js.Object
+}
+
+var terminal terminalPane
+
+// escapeRe matches the terminal escape sequences that the pane ignores.
+var escapeRe = regexp.MustCompile(`\x1b(\[[0-9;?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[()][0-9A-Za-z]|[=>78])`)
+
+// terminalKeys are the bytes that keys without a character of their own send.
+var terminalKeys = map[string]string{
+	"Enter":      "\r",
+	"Backspace":  "\x7f",
+	"Tab":        "\t",
+	"Escape":     "\x1b",
+	"ArrowUp":    "\x1b[A",
+	"ArrowDown":  "\x1b[B",
+	"ArrowRight": "\x1b[C",
+	"ArrowLeft":  "\x1b[D",
+	"Home":       "\x1b[H",
+	"End":        "\x1b[F",
+	"Delete":     "\x1b[3~",
+}
+
+// setupTerminal wires up the terminal pane's controls.  Keys pressed and text
+// pasted while the output has focus are sent to the shell.
+func setupTerminal(doc *js.Object) {
+	terminal.doc = doc
+	output := doc.Call("getElementById", "term-output")
+	output.Call("addEventListener", "keydown", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		e := args[0]
+		if e.Get("metaKey").Bool() || e.Get("altKey").Bool() {
+			return nil
+		}
+		key := e.Get("key").String()
+		data, ok := terminalKeys[key]
+		switch {
+		case ok:
+		case len(key) == 1 && e.Get("ctrlKey").Bool():
+			c := key[0]
+			if c >= 'a' && c <= 'z' || c >= '@' && c <= '_' {
+				data = string(c & 0x1f)
+			}
+		case len([]rune(key)) == 1:
+			data = key
+		}
+		if data == "" {
+			return nil
+		}
+		e.Call("preventDefault")
+		terminal.send(streamMessage{Stream: StreamTypeStdin, Data: data})
+		return nil
+	}), false)
+	output.Call("addEventListener", "paste", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		e := args[0]
+		e.Call("preventDefault")
+		terminal.send(streamMessage{Stream: StreamTypeStdin, Data: e.Get("clipboardData").Call("getData", "text").String()})
+		return nil
+	}), false)
+	doc.Call("getElementById", "term-close").Call("addEventListener", "click", js.MakeFunc(func(this *js.Object, args []*js.Object) interface{} {
+		terminal.close()
+		return nil
+	}), false)
+}
+
+// show opens the terminal pane on a new shell in the first pod of t.
+func (tp *terminalPane) show(t execTarget) {
+	tp.stop()
+	var sel []string
+	for k, v := range t.selector {
+		sel = append(sel, k+"="+v)
+	}
+	q := url.Values{}
+	q.Set("cluster", t.cluster)
+	q.Set("namespace", t.namespace)
+	q.Set("selector", strings.Join(sel, ","))
+	q.Set("container", t.container)
+	q.Set("tty", "true")
+	loc := js.Global.Get("location")
+	scheme := "ws:"
+	if loc.Get("protocol").String() == "https:" {
+		scheme = "wss:"
+	}
+
+	output := tp.doc.Call("getElementById", "term-output")
+	output.Set("textContent", "")
+	tp.doc.Call("getElementById", "term-title").Set("textContent", fmt.Sprintf("Shell in %s in %s ", t.title, t.namespace))
+	tp.doc.Call("getElementById", "term-pane").Get("style").Set("display", "block")
+
+	socket := js.Global.Get("WebSocket").New(fmt.Sprintf("%s//%s/exec/?%s", scheme, loc.Get("host"), q.Encode()))
+	tp.socket = socket
+	socket.Set("onopen", func() {
+		tp.send(streamMessage{Stream: StreamTypeResize, Cols: terminalCols, Rows: terminalRows})
+		output.Call("focus")
+	})
+	socket.Set("onmessage", func(e *js.Object) {
+		if tp.socket != socket {
+			return
+		}
+		var msg streamMessage
+		if err := json.Unmarshal([]byte(e.Get("data").String()), &msg); err != nil {
+			return
+		}
+		switch msg.Stream {
+		case StreamTypeStdout, StreamTypeStderr:
+			tp.write(msg.Data)
+		case StreamTypeError:
+			tp.write(fmt.Sprintf("\r\n[%s]\r\n", msg.Data))
+		}
+	})
+	socket.Set("onclose", func() {
+		if tp.socket != socket {
+			return
+		}
+		tp.socket = nil
+		tp.write("\r\n[session ended]\r\n")
+	})
+}
+
+// write adds data from the shell to the output, handling the control
+// characters that a shell commonly sends.
+func (tp *terminalPane) write(data string) {
+	output := tp.doc.Call("getElementById", "term-output")
+	text := []rune(output.Get("textContent").String())
+	for _, r := range escapeRe.ReplaceAllString(data, "") {
+		switch r {
+		case '\r', '\a', 0:
+		case '\b':
+			if len(text) > 0 && text[len(text)-1] != '\n' {
+				text = text[:len(text)-1]
+			}
+		default:
+			text = append(text, r)
+		}
+	}
+	if len(text) > maxLogText {
+		text = text[len(text)-maxLogText:]
+	}
+	output.Set("textContent", string(text))
+	output.Set("scrollTop", output.Get("scrollHeight"))
+}
+
+func (tp *terminalPane) send(msg streamMessage) {
+	if tp.socket == nil || tp.socket.Get("readyState").Int() != 1 {
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	tp.socket.Call("send", string(data))
+}
+
+func (tp *terminalPane) close() {
+	tp.stop()
+	tp.doc.Call("getElementById", "term-pane").Get("style").Set("display", "none")
+}
+
+func (tp *terminalPane) stop() {
+	if tp.socket != nil {
+		tp.socket.Call("close")
+		tp.socket = nil
+	}
+}
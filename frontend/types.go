@@ -1261,7 +1261,7 @@ type ServicePort struct {
 	// is a string, it will be looked up as a named port in the target
 	// Pod's container ports.  If this is not specified, the default value
 	// is the sames as the Port field (an identity map).
-	TargetPort int `json:"targetPort"`
+	TargetPort IntOrString `json:"targetPort"`
 
 	// The port on each node on which this service is exposed.
 	// Default is to auto-allocate a port if the ServiceType of this Service requires one.
@@ -1324,7 +1324,7 @@ type Endpoints struct {
 	ObjectMeta           `json:"metadata,omitempty"`
 
 	// The set of all endpoints is the union of all subsets.
-	Subsets []EndpointSubset
+	Subsets []EndpointSubset `json:"subsets"`
 }
 
 // EndpointSubset is a group of addresses with a common set of ports.  The
@@ -1338,32 +1338,32 @@ type Endpoints struct {
 //     a: [ 10.10.1.1:8675, 10.10.2.2:8675 ],
 //     b: [ 10.10.1.1:309, 10.10.2.2:309 ]
 type EndpointSubset struct {
-	Addresses         []EndpointAddress
-	NotReadyAddresses []EndpointAddress
-	Ports             []EndpointPort
+	Addresses         []EndpointAddress `json:"addresses,omitempty"`
+	NotReadyAddresses []EndpointAddress `json:"notReadyAddresses,omitempty"`
+	Ports             []EndpointPort    `json:"ports,omitempty"`
 }
 
 // EndpointAddress is a tuple that describes single IP address.
 type EndpointAddress struct {
 	// The IP of this endpoint.
 	// TODO: This should allow hostname or IP, see #4447.
-	IP string
+	IP string `json:"ip"`
 
 	// Optional: The kubernetes object related to the entry point.
-	TargetRef *ObjectReference
+	TargetRef *ObjectReference `json:"targetRef,omitempty"`
 }
 
 // EndpointPort is a tuple that describes a single port.
 type EndpointPort struct {
 	// The name of this port (corresponds to ServicePort.Name).  Optional
 	// if only one port is defined.  Must be a DNS_LABEL.
-	Name string
+	Name string `json:"name,omitempty"`
 
 	// The port number.
-	Port int
+	Port int `json:"port"`
 
 	// The IP protocol for this port.
-	Protocol Protocol
+	Protocol Protocol `json:"protocol,omitempty"`
 }
 
 // EndpointsList is a list of endpoints.
@@ -1507,7 +1507,7 @@ const (
 )
 
 // ResourceList is a set of (resource name, quantity) pairs.
-type ResourceList map[ResourceName]int // resource.Quantity
+type ResourceList map[ResourceName]Quantity
 
 // Node is a worker node in Kubernetes
 // The name of the node according to etcd is in ObjectMeta.Name.
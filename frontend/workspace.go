@@ -7,10 +7,11 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,14 +25,29 @@ type Workspace struct {
 	doc          *js.Object
 	canvas, ctx  *js.Object
 	x, y, dx, dy int
-	images       chan schema.ImageManifest
+	images       chan containerInfo
 	disks        chan string
-	ingresses    chan int
+	ingresses    chan *portObj
+	externals    chan externalNode
+	pinPorts     chan int
 	draw         chan struct{}
 	mouseDown    chan point
 	mouseMove    chan point
 	mouseUp      chan point
+	contextMenu  chan point
+	namespaces   chan namespaceSetting
+	clusters     chan clusterTarget
+	events       chan nodeEvent
+	watchEnded   chan string
+	nodeNS       chan nodeNamespace
+	nodePlatform chan nodePlatform
+	signatures   chan nodePlatform
+	workspaceIDs chan string
+	importNS     chan string
+	imports      chan *importedGraph
+	adopt        chan *pod
 	makeItSo     chan struct{}
+	tearDown     chan bool
 	cut          chan struct{}
 }
 
@@ -39,26 +55,42 @@ func MakeWorkspace(canvas *js.Object) *Workspace {
 	doc := js.Global.Get("document")
 	ctx := canvas.Call("getContext", "2d")
 	w := &Workspace{
-		doc:       doc,
-		canvas:    canvas,
-		ctx:       ctx,
-		x:         canvas.Get("offsetLeft").Int(),
-		y:         canvas.Get("offsetTop").Int(),
-		dx:        canvas.Get("offsetWidth").Int(),
-		dy:        canvas.Get("offsetHeight").Int(),
-		images:    make(chan schema.ImageManifest),
-		disks:     make(chan string),
-		ingresses: make(chan int),
-		draw:      make(chan struct{}),
-		mouseDown: make(chan point),
-		mouseMove: make(chan point),
-		mouseUp:   make(chan point),
-		makeItSo:  make(chan struct{}),
-		cut:       make(chan struct{}),
+		doc:          doc,
+		canvas:       canvas,
+		ctx:          ctx,
+		x:            canvas.Get("offsetLeft").Int(),
+		y:            canvas.Get("offsetTop").Int(),
+		dx:           canvas.Get("offsetWidth").Int(),
+		dy:           canvas.Get("offsetHeight").Int(),
+		images:       make(chan containerInfo),
+		disks:        make(chan string),
+		ingresses:    make(chan *portObj),
+		externals:    make(chan externalNode),
+		pinPorts:     make(chan int),
+		draw:         make(chan struct{}),
+		mouseDown:    make(chan point),
+		mouseMove:    make(chan point),
+		mouseUp:      make(chan point),
+		contextMenu:  make(chan point),
+		namespaces:   make(chan namespaceSetting),
+		clusters:     make(chan clusterTarget),
+		events:       make(chan nodeEvent),
+		watchEnded:   make(chan string),
+		nodeNS:       make(chan nodeNamespace),
+		nodePlatform: make(chan nodePlatform),
+		signatures:   make(chan nodePlatform),
+		workspaceIDs: make(chan string),
+		importNS:     make(chan string),
+		imports:      make(chan *importedGraph),
+		adopt:        make(chan *pod),
+		makeItSo:     make(chan struct{}),
+		tearDown:     make(chan bool),
+		cut:          make(chan struct{}),
 	}
 	doc.Call("addEventListener", "mousedown", js.MakeFunc(w.onMouseDown), "false")
 	doc.Call("addEventListener", "mousemove", js.MakeFunc(w.onMouseMove), "false")
 	doc.Call("addEventListener", "mouseup", js.MakeFunc(w.onMouseUp), "false")
+	canvas.Call("addEventListener", "contextmenu", js.MakeFunc(w.onContextMenu), "false")
 	go w.run()
 	return w
 }
@@ -70,16 +102,106 @@ func (w *Workspace) run() {
 		case <-w.draw:
 			// Let's us force a draw if we need to for some reason.
 
-		case im := <-w.images:
-			state.pods = append(state.pods, MakePod(&im, w.ctx))
+		case info := <-w.images:
+			p := MakePod(&info.Manifest, w.ctx)
+			if p == nil {
+				SetToast("toaster", ToastError, fmt.Sprintf("Image %s doesn't define an app", info.Manifest.Name))
+				break
+			}
+			p.signature = info.Signature
+			p.layers = info.Layers
+			p.image = info.Image
+			p.undeployable = info.Undeployable
+			p.source = info.source
+			p.platform = info.platform
+			if info.at != nil {
+				p.x = info.at.x - p.dx/2
+				p.y = info.at.y - p.dy/2
+			}
+			state.pods = append(state.pods, p)
+			if p.signature.pending() {
+				go w.awaitSignature(p, p.source, p.platform)
+			}
 
 		case disk := <-w.disks:
 			state.pods = append(state.pods, MakeDisk(disk, w.ctx))
 
-		case port := <-w.ingresses:
-			state.pods = append(state.pods, MakeIngress(port, w.ctx))
+		case po := <-w.ingresses:
+			state.pods = append(state.pods, MakeIngress(po, w.ctx))
+
+		case en := <-w.externals:
+			p := MakeExternal(en.obj, w.ctx)
+			p.namespace = en.namespace
+			state.pods = append(state.pods, p)
+
+		case ns := <-w.namespaces:
+			state.namespace = ns
+
+		case id := <-w.workspaceIDs:
+			workspaceID = id
+			state.stopEventWatches()
+			SetToast("toaster", ToastSuccess, fmt.Sprintf("Deploying and tearing down as workspace %s", id))
+
+		case c := <-w.clusters:
+			state.cluster = c
+			state.stopEventWatches()
+
+		case ne := <-w.events:
+			state.addEvent(ne)
+
+		case key := <-w.watchEnded:
+			delete(state.eventWatches, key)
+
+		case ns := <-w.nodeNS:
+			ns.pod.namespace = ns.name
+
+		case np := <-w.nodePlatform:
+			np.pod.platform = np.platform
+			np.pod.image = np.info.Image
+			np.pod.undeployable = np.info.Undeployable
+			np.pod.signature = np.info.Signature
+			np.pod.layers = np.info.Layers
+			if np.pod.signature.pending() {
+				go w.awaitSignature(np.pod, np.pod.source, np.platform)
+			}
+
+		case np := <-w.signatures:
+			// The node may have been moved to another platform while its
+			// image was downloading, in which case this is for the old one.
+			if np.pod.platform != np.platform {
+				break
+			}
+			np.pod.signature = np.info.Signature
+			np.pod.layers = np.info.Layers
+			if !np.info.Signature.verified() {
+				SetToast("toaster", ToastWarning, fmt.Sprintf("Image %s is %s: %s", np.info.Manifest.Name, np.info.Signature.Status, np.info.Signature.Message))
+			}
+
+		case ns := <-w.importNS:
+			if ns == "" {
+				ns = state.namespaceOf(&pod{})
+			}
+			go w.importNamespace(state.cluster, ns)
+
+		case g := <-w.imports:
+			state.addImported(g)
+
+		case p := <-w.adopt:
+			p.imported.adopted = true
+			SetToast("toaster", ToastSuccess, fmt.Sprintf("%s will be deployed by flow from now on", p.manifest.Name))
+
+		case port := <-w.pinPorts:
+			if state.selectedEdge == nil {
+				SetToast("toaster", ToastWarning, "Select an edge to pin its port.")
+				break
+			}
+			if err := state.selectedEdge.Pin(port); err != nil {
+				SetToast("toaster", ToastWarning, err.Error())
+			}
 
 		case pt := <-w.mouseDown:
+			state.selectedEdge = nil
+			hit := false
 			for i := range state.pods {
 				anch := state.pods[i].AnchorAt(pt)
 				if anch != nil {
@@ -87,6 +209,7 @@ func (w *Workspace) run() {
 						src:  anch,
 						temp: pt,
 					}
+					hit = true
 					break
 				}
 				if state.pods[i].Contains(pt) {
@@ -98,6 +221,18 @@ func (w *Workspace) run() {
 					}
 					state.pods = pods
 					state.pods[0].Click(pt)
+					hit = true
+					break
+				}
+			}
+			if !hit {
+				state.selectedEdge = state.edgeAt(pt)
+			}
+
+		case pt := <-w.contextMenu:
+			for _, p := range state.pods {
+				if p.Contains(pt) {
+					w.showNodeMenu(&state, p, pt)
 					break
 				}
 			}
@@ -114,32 +249,8 @@ func (w *Workspace) run() {
 			if len(state.pods) > 0 && state.pods[0].selected {
 				if time.Since(state.pods[0].selectTime) < 500*time.Millisecond && state.pods[0].drag.x == pt.x && state.pods[0].drag.y == pt.y {
 					// This is a click!
-					if state.pods[0].port > 0 {
-						var e *edge
-						for _, ed := range state.edges {
-							if ed.complete && ed.src.pod == state.pods[0] {
-								e = ed
-								break
-							}
-						}
-						if e != nil {
-							go func(p *pod) {
-								if p.manifest == nil {
-									return
-								}
-								s, err := state.getService(makeNiceName(p.manifest.Name.String()))
-								if err != nil {
-									return
-								}
-								ingress := s.Status.LoadBalancer.Ingress
-								ports := s.Spec.Ports
-								if len(ingress) > 0 && len(ports) > 0 {
-									js.Global.Get("window").Call("open", fmt.Sprintf("http://%s:%d", ingress[0].IP, ports[0].Port))
-								} else {
-									SetToast("toaster", ToastWarning, "External load balancer isn't ready yet.")
-								}
-							}(e.dst.pod)
-						}
+					if state.pods[0].ingress != nil {
+						w.showNodeMenu(&state, state.pods[0], pt)
 					}
 				}
 				state.pods[0].Release(pt)
@@ -150,10 +261,8 @@ func (w *Workspace) run() {
 					if anch != nil {
 						state.connect.dst = anch
 						state.connect.complete = true
-						if err := state.connect.Check(); err != nil {
+						if err := state.addEdge(state.connect); err != nil {
 							SetToast("toaster", ToastWarning, err.Error())
-						} else {
-							state.edges = append(state.edges, state.connect)
 						}
 						break
 					}
@@ -179,9 +288,15 @@ func (w *Workspace) run() {
 
 		case <-w.makeItSo:
 			if err := state.runKubectlStuff(); err != nil {
-				SetToast("toaster", ToastError, fmt.Sprintf("Failed to bring everything up: %v", err))
+				SetToast("toaster", ToastError, fmt.Sprintf("Failed to bring everything up on %s: %v", state.clusterName(), err))
+			}
+
+		case keepData := <-w.tearDown:
+			if err := state.tearDown(keepData); err != nil {
+				SetToast("toaster", ToastError, fmt.Sprintf("Failed to tear everything down on %s: %v", state.clusterName(), err))
 			}
 		}
+		state.watchEvents(w)
 		w.doDraw(&state)
 	}
 }
@@ -190,39 +305,142 @@ type workspaceState struct {
 	pods  []*pod
 	edges []*edge
 
-	connect *edge
+	connect      *edge
+	selectedEdge *edge
+
+	namespace namespaceSetting
+
+	// cluster is where the workspace is deployed, the server's default until
+	// one is picked.
+	cluster clusterTarget
+
+	// eventWatches are the requests streaming events, by eventWatchKey.
+	eventWatches map[string]*js.Object
+}
+
+// clusterName describes the cluster that the workspace is deployed to.
+func (ws *workspaceState) clusterName() string {
+	if ws.cluster.Name == "" {
+		return "the default cluster"
+	}
+	return "cluster " + ws.cluster.Name
+}
+
+// addEdge checks e and adds it to the workspace if it's valid.
+func (ws *workspaceState) addEdge(e *edge) error {
+	if err := e.Check(); err != nil {
+		return err
+	}
+	if po, ok := e.src.obj.(*portObj); ok && po.typ == ingressHTTP {
+		for _, other := range ws.edges {
+			if other.complete && other.src == e.src {
+				return fmt.Errorf("an http ingress can only route to one port")
+			}
+		}
+	}
+	ws.edges = append(ws.edges, e)
+	return nil
+}
+
+// edgeAt returns the complete edge whose midpoint is near pt, if any.
+func (ws *workspaceState) edgeAt(pt point) *edge {
+	for _, e := range ws.edges {
+		if !e.complete {
+			continue
+		}
+		mid := e.midpoint()
+		dx := mid.x - pt.x
+		dy := mid.y - pt.y
+		if dx*dx+dy*dy < 100 {
+			return e
+		}
+	}
+	return nil
 }
 
 func (ws *workspaceState) runKubectlStuff() error {
+	rememberNamespaces(ws.cluster.Name, ws.namespacesInUse())
+	if err := ws.ensureNamespaces(); err != nil {
+		return err
+	}
+
 	// Create all services first
 	services := make(map[*pod]*Service)
 	for _, p := range ws.pods {
+		if p.manifest == nil || p.external() {
+			continue
+		}
+		if p.undeployable != "" {
+			SetToast("toaster", ToastWarning, fmt.Sprintf("Skipping %s: %s", p.manifest.Name, p.undeployable))
+			continue
+		}
 		service, err := ws.createServiceObject(p)
 		if err != nil {
-			continue
+			return err
 		}
 		services[p] = service
 	}
 
+	ingresses, err := ws.createIngressObjects()
+	if err != nil {
+		return err
+	}
+
+	// Published external endpoints are services too, and have to exist before
+	// anything that uses them.
+	for _, p := range ws.pods {
+		if p.ext == nil || p.ext.publish == "" {
+			continue
+		}
+		service, endpoints := ws.createExternalObjects(p)
+		if err := ws.createService(service); err != nil {
+			return fmt.Errorf("failed to create service %s: %v", service.Name, err)
+		}
+		if err := ws.createObject(endpoints); err != nil {
+			return fmt.Errorf("failed to create endpoints %s: %v", endpoints.Name, err)
+		}
+	}
+
 	log.Printf("Creating %d services", len(services))
 	for p := range services {
 		log.Printf("Service %s", p.manifest.Name)
 	}
 
 	for p, service := range services {
+		if p.imported != nil {
+			if err := ws.applyObject(service); err != nil {
+				return fmt.Errorf("failed to apply service %s: %v", p.manifest.Name, err)
+			}
+			continue
+		}
 		if err := ws.createService(service); err != nil {
-			return fmt.Errorf("failed to create service %s: %v", p.manifest.Name, service)
+			return fmt.Errorf("failed to create service %s: %v", p.manifest.Name, err)
+		}
+	}
+
+	for _, ingress := range ingresses {
+		if err := ws.createObject(ingress); err != nil {
+			return fmt.Errorf("failed to create ingress %s/%s: %v", ingress.Namespace, ingress.Name, err)
 		}
 	}
 
 	// Create replication controllers
 	rcs := make(map[*pod]*ReplicationController)
 	for _, p := range ws.pods {
+		if p.external() || p.undeployable != "" {
+			continue
+		}
 		rc, err := ws.createReplicationControllerObject(p)
 		if err != nil {
 			continue
 		}
 		rcs[p] = rc
+		if p.imported != nil {
+			if err := ws.applyObject(rc); err != nil {
+				SetToast("toaster", ToastError, fmt.Sprintf("Failed to apply RC %s: %v", p.manifest.Name.String(), err))
+			}
+			continue
+		}
 		if err := ws.createReplicationController(rc); err != nil {
 			SetToast("toaster", ToastError, fmt.Sprintf("Failed to create RC %s: %v", p.manifest.Name.String(), err))
 		}
@@ -241,31 +459,53 @@ func (ws *workspaceState) createReplicationControllerObject(p *pod) (*Replicatio
 			Kind:       "ReplicationController",
 		},
 		ObjectMeta: ObjectMeta{
-			Labels: map[string]string{"flow-id": makeNiceName(p.manifest.Name.String())},
-			Name:   makeNiceName(p.manifest.Name.String()),
+			Labels:    objectLabels(makeNiceName(p.manifest.Name.String())),
+			Name:      makeNiceName(p.manifest.Name.String()),
+			Namespace: ws.namespaceOf(p),
 		},
 		Spec: ReplicationControllerSpec{
 			Replicas: 1,
 			Selector: map[string]string{"flow-id": makeNiceName(p.manifest.Name.String())},
 			Template: &PodTemplateSpec{
 				ObjectMeta: ObjectMeta{
-					Labels: map[string]string{"flow-id": makeNiceName(p.manifest.Name.String())},
+					Labels: objectLabels(makeNiceName(p.manifest.Name.String())),
 					Name:   makeNiceName(p.manifest.Name.String()),
 				},
 				Spec: PodSpec{
-				// SecurityContext: &PodSecurityContext{
-				// // HostNetwork: true,
-				// },
+					NodeSelector: p.platform.nodeSelector(),
+					// SecurityContext: &PodSecurityContext{
+					// // HostNetwork: true,
+					// },
 				},
 			},
 		},
 	}
 
+	image := p.image
+	if image == "" {
+		image = p.manifest.Name.String() + ":0.0.1"
+	}
+
 	// This could support multiple containers per pod if we just do this part more than once.
 	rc.Spec.Template.Spec.Containers = append(rc.Spec.Template.Spec.Containers, Container{
 		Name:  makeNiceName(p.manifest.Name.String()),
-		Image: p.manifest.Name.String() + ":0.0.1",
+		Image: image,
 	})
+	if in := p.imported; in != nil {
+		// An adopted node keeps everything about its pods that the graph
+		// doesn't describe, and its selector so that its pods stay its own.
+		name := makeNiceName(p.manifest.Name.String())
+		orig := in.rc.Spec.Template
+		rc.Labels = mergeLabels(in.rc.Labels, objectLabels(name))
+		rc.Spec.Replicas = in.rc.Spec.Replicas
+		rc.Spec.Selector = in.selector()
+		rc.Spec.Template.Labels = mergeLabels(orig.Labels, objectLabels(name))
+		rc.Spec.Template.Spec = orig.Spec
+		rc.Spec.Template.Spec.Volumes = append([]Volume(nil), in.volumes...)
+		rc.Spec.Template.Spec.Containers = append([]Container(nil), orig.Spec.Containers...)
+		rc.Spec.Template.Spec.Containers[0].Args = append([]string(nil), in.args...)
+		rc.Spec.Template.Spec.Containers[0].VolumeMounts = append([]VolumeMount(nil), in.mounts...)
+	}
 	spec := &rc.Spec.Template.Spec
 	container := &spec.Containers[0]
 	for _, e := range ws.edges {
@@ -273,30 +513,45 @@ func (ws *workspaceState) createReplicationControllerObject(p *pod) (*Replicatio
 			continue
 		}
 		if e.src.pod == p {
-			if rf, ok := e.src.obj.(*requiredFlag); ok {
-				if _, ok := e.dst.obj.(*types.Port); ok && rf.typ == "host-port" {
+			if rf, ok := e.src.obj.(*requiredFlag); ok && rf.typ == "host-port" {
+				var host string
+				var err error
+				switch e.dst.obj.(type) {
+				case *types.Port:
 					// Find the service and use the service's host-port
-					s, err := ws.getService(makeNiceName(e.dst.pod.manifest.Name.String()))
-					if err != nil {
-						return nil, fmt.Errorf("unable to get service %q: %v", e.dst.pod.manifest.Name, err)
-					}
-					hostPort := fmt.Sprintf("--%s=%s:%d", rf.flag, s.Spec.ClusterIP, s.Spec.Ports[0].Port)
-					container.Args = append(container.Args, hostPort)
+					host, err = ws.serviceHost(e)
+				case *externalObj:
+					host, err = ws.externalHost(e)
+				default:
+					continue
+				}
+				if err != nil {
+					return nil, err
 				}
+				port, err := ws.servicePortFor(e)
+				if err != nil {
+					return nil, err
+				}
+				hostPort := fmt.Sprintf("--%s=%s", rf.flag, net.JoinHostPort(host, strconv.Itoa(port)))
+				container.Args = append(container.Args, hostPort)
 			}
 			if mp, ok := e.src.obj.(*types.MountPoint); ok {
 				do, ok := e.dst.obj.(diskObj)
 				if !ok {
 					return nil, fmt.Errorf("MountPoint connected to an unexpected type %T", e.dst.obj)
 				}
-				spec.Volumes = append(spec.Volumes, Volume{
-					Name: string(do),
-					VolumeSource: VolumeSource{
-						GCEPersistentDisk: &GCEPersistentDiskVolumeSource{
-							PDName: string(do),
-							FSType: "ext4",
-						},
+				source := VolumeSource{
+					GCEPersistentDisk: &GCEPersistentDiskVolumeSource{
+						PDName: string(do),
+						FSType: "ext4",
 					},
+				}
+				if e.dst.pod.volume != nil {
+					source = *e.dst.pod.volume
+				}
+				spec.Volumes = append(spec.Volumes, Volume{
+					Name:         string(do),
+					VolumeSource: source,
 				})
 				container.VolumeMounts = append(container.VolumeMounts, VolumeMount{
 					Name:      string(do),
@@ -313,6 +568,23 @@ func (ws *workspaceState) createReplicationController(rc *ReplicationController)
 	return ws.createObject(rc)
 }
 
+// flowManagedLabel is set on everything flow creates so that it can all be
+// found again later, and workspaceLabel says which workspace created it so that
+// tearing one workspace down leaves everyone else's alone.
+const (
+	flowManagedLabel = "flow-managed"
+	workspaceLabel   = "flow-workspace"
+)
+
+// workspaceID is this workspace's value of workspaceLabel, see
+// setupWorkspaceID.  Once the workspace is running only run changes it.
+var workspaceID string
+
+// objectLabels returns the labels for an object that flow creates for id.
+func objectLabels(id string) map[string]string {
+	return map[string]string{"flow-id": id, flowManagedLabel: "true", workspaceLabel: workspaceID}
+}
+
 func makeNiceName(str string) string {
 	str = strings.Replace(str, "/", "-", -1)
 	str = strings.Replace(str, ".", "-", -1)
@@ -322,8 +594,43 @@ func makeNiceName(str string) string {
 	return str
 }
 
-func randoport() int {
-	return rand.Intn(10000) + 10000
+// portAllocator hands out the ports exposed by a single Service.  Ports are
+// handed out in the order they are requested, so generating a Service from the
+// same graph always produces the same ports.
+type portAllocator struct {
+	used map[int]bool
+}
+
+func newPortAllocator() *portAllocator {
+	return &portAllocator{used: make(map[int]bool)}
+}
+
+// reserve claims exactly port, failing if it is out of range or already taken.
+func (a *portAllocator) reserve(port int) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("port %d is out of range", port)
+	}
+	if a.used[port] {
+		return fmt.Errorf("port %d is already in use", port)
+	}
+	a.used[port] = true
+	return nil
+}
+
+// allocate claims want if it is free, otherwise the next free port above it,
+// wrapping around to the bottom of the port range if necessary.
+func (a *portAllocator) allocate(want int) (int, error) {
+	if want <= 0 || want > 65535 {
+		want = 1
+	}
+	for i := 0; i < 65535; i++ {
+		port := (want-1+i)%65535 + 1
+		if !a.used[port] {
+			a.used[port] = true
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free ports")
 }
 
 func (ws *workspaceState) createServiceObject(p *pod) (*Service, error) {
@@ -336,110 +643,244 @@ func (ws *workspaceState) createServiceObject(p *pod) (*Service, error) {
 			Kind:       "Service",
 		},
 		ObjectMeta: ObjectMeta{
-			Labels: map[string]string{"flow-id": makeNiceName(p.manifest.Name.String())},
-			Name:   makeNiceName(p.manifest.Name.String()),
+			Labels:    objectLabels(makeNiceName(p.manifest.Name.String())),
+			Name:      ws.serviceName(p),
+			Namespace: ws.namespaceOf(p),
 		},
 		Spec: ServiceSpec{
 			Selector: map[string]string{"flow-id": makeNiceName(p.manifest.Name.String())},
 		},
 	}
-	usedAnchors := make(map[*podAnchor]bool)
+	// An adopted node's service keeps its selector and ports, so that whatever
+	// used it before still can.
+	var origPorts []ServicePort
+	var origContainerPorts []ContainerPort
+	if in := p.imported; in != nil {
+		service.Spec.Selector = in.selector()
+		if in.service != nil {
+			service.Labels = mergeLabels(in.service.Labels, service.Labels)
+			service.Spec.Type = in.service.Spec.Type
+			origPorts = in.service.Spec.Ports
+			origContainerPorts = in.containerPorts()
+		}
+	}
+
+	// Every container port that something is connected to gets exactly one port
+	// on the service.  Ingress ports and pinned ports are fixed, everything else
+	// defaults to the container port itself.
+	type exposed struct {
+		anchor   *podAnchor
+		target   *types.Port
+		fixed    int
+		nodePort int
+	}
+	var ports []*exposed
+	byAnchor := make(map[*podAnchor]*exposed)
 	for _, e := range ws.edges {
 		if !e.complete || e.dst.pod != p {
 			continue
 		}
-		if usedAnchors[e.dst] {
+		dstPort, ok := e.dst.obj.(*types.Port)
+		if !ok {
 			continue
 		}
-		var dst uint
-		if dstPort, ok := e.dst.obj.(*types.Port); !ok {
-			continue
+		var fixed, nodePort int
+		log.Printf("Checking edge with src of type %T", e.src.obj)
+		if po, ok := e.src.obj.(*portObj); ok {
+			if typ := po.serviceType(); serviceTypeRank[typ] > serviceTypeRank[service.Spec.Type] {
+				service.Spec.Type = typ
+			}
+			if po.typ != ingressHTTP {
+				fixed = po.port
+				nodePort = po.nodePort
+			}
+		} else if rf, ok := e.src.obj.(*requiredFlag); ok && rf.typ == "host-port" {
+			fixed = e.port
 		} else {
-			dst = dstPort.Port
+			continue
 		}
-		log.Printf("Checking edge with src of type %T", e.src.obj)
-		if srcPort, ok := e.src.obj.(portObj); ok {
-			service.Spec.Type = ServiceTypeLoadBalancer
-			service.Spec.Ports = append(service.Spec.Ports, ServicePort{
-				Port:       int(srcPort),
-				TargetPort: int(dst),
-				Protocol:   ProtocolTCP,
-			})
-			usedAnchors[e.dst] = true
+		ex, ok := byAnchor[e.dst]
+		if !ok {
+			ex = &exposed{anchor: e.dst, target: dstPort}
+			byAnchor[e.dst] = ex
+			ports = append(ports, ex)
 		}
-		if rf, ok := e.src.obj.(*requiredFlag); ok && rf.typ == "host-port" {
-			service.Spec.Ports = append(service.Spec.Ports, ServicePort{
-				Port:       randoport(),
-				TargetPort: int(dst),
-				Protocol:   ProtocolTCP,
-			})
-			usedAnchors[e.dst] = true
+		if fixed != 0 {
+			if ex.fixed != 0 && ex.fixed != fixed {
+				return nil, fmt.Errorf("%s:%d is exposed as both port %d and port %d", p.manifest.Name, dstPort.Port, ex.fixed, fixed)
+			}
+			ex.fixed = fixed
+		}
+		if nodePort != 0 {
+			if ex.nodePort != 0 && ex.nodePort != nodePort {
+				return nil, fmt.Errorf("%s:%d is exposed as both node port %d and node port %d", p.manifest.Name, dstPort.Port, ex.nodePort, nodePort)
+			}
+			ex.nodePort = nodePort
 		}
 	}
-	return &service, nil
-}
 
-func (ws *workspaceState) getService(name string) (*Service, error) {
-	body := bytes.NewBuffer(nil)
-	var boundary string
-	{
-		mpw := multipart.NewWriter(body)
-		w, err := mpw.CreateFormField("cmd")
+	alloc := newPortAllocator()
+	origByTarget := make(map[int]int)
+	for _, sp := range origPorts {
+		alloc.reserve(sp.Port)
+		origByTarget[servicePortTarget(sp, origContainerPorts)] = sp.Port
+	}
+	assigned := make(map[*exposed]int)
+	for _, ex := range ports {
+		if ex.fixed == 0 {
+			if port, ok := origByTarget[int(ex.target.Port)]; ok {
+				assigned[ex] = port
+			}
+			continue
+		}
+		if port, ok := origByTarget[int(ex.target.Port)]; ok && port == ex.fixed {
+			assigned[ex] = port
+			continue
+		}
+		if err := alloc.reserve(ex.fixed); err != nil {
+			return nil, fmt.Errorf("unable to expose %s:%d: %v", p.manifest.Name, ex.target.Port, err)
+		}
+		assigned[ex] = ex.fixed
+	}
+	for _, ex := range ports {
+		if _, ok := assigned[ex]; ok {
+			continue
+		}
+		port, err := alloc.allocate(int(ex.target.Port))
 		if err != nil {
-			return nil, fmt.Errorf("unable to create kubeclt command to multipart writer: %v", err)
+			return nil, fmt.Errorf("unable to expose %s:%d: %v", p.manifest.Name, ex.target.Port, err)
 		}
-		if _, err := io.Copy(w, bytes.NewBufferString(fmt.Sprintf("get service %s -o json", name))); err != nil {
-			return nil, fmt.Errorf("unable to write kubeclt command to multipart writer: %v", err)
+		assigned[ex] = port
+	}
+	for _, ex := range ports {
+		service.Spec.Ports = append(service.Spec.Ports, ServicePort{
+			Name:       ex.target.Name.String(),
+			Port:       assigned[ex],
+			TargetPort: IntOrString{IntVal: int(ex.target.Port)},
+			NodePort:   ex.nodePort,
+			Protocol:   ProtocolTCP,
+		})
+	}
+	for _, sp := range origPorts {
+		exposed := false
+		for _, ex := range ports {
+			exposed = exposed || int(ex.target.Port) == servicePortTarget(sp, origContainerPorts)
 		}
-		boundary = mpw.Boundary()
-		if err := mpw.Close(); err != nil {
-			return nil, fmt.Errorf("error closing multipart writer: %v", err)
+		if !exposed {
+			service.Spec.Ports = append(service.Spec.Ports, sp)
 		}
 	}
+	return &service, nil
+}
 
-	req, _ := http.NewRequest("POST", "/kubectl/", body)
-	req.Header.Set("Content-Type", fmt.Sprintf("multipart/form-data; boundary=%s", boundary))
-	resp, err := http.DefaultClient.Do(req)
+// servicePortFor returns the port on the destination's Service that the edge
+// e will be routed through.
+func (ws *workspaceState) servicePortFor(e *edge) (int, error) {
+	if eo, ok := e.dst.obj.(*externalObj); ok {
+		return eo.port, nil
+	}
+	dstPort, ok := e.dst.obj.(*types.Port)
+	if !ok {
+		return 0, fmt.Errorf("edge does not end at a port")
+	}
+	if e.dst.pod.external() {
+		in := e.dst.pod.imported
+		if in.service == nil {
+			return 0, fmt.Errorf("%s has no service", e.dst.pod.manifest.Name)
+		}
+		for _, sp := range in.service.Spec.Ports {
+			if servicePortTarget(sp, in.containerPorts()) == int(dstPort.Port) {
+				return sp.Port, nil
+			}
+		}
+		return 0, fmt.Errorf("service %s does not expose port %d", in.service.Name, dstPort.Port)
+	}
+	s, err := ws.createServiceObject(e.dst.pod)
 	if err != nil {
-		return nil, fmt.Errorf("failed to run remote kubectl: %v", err)
+		return 0, err
 	}
-	rd, _ := ioutil.ReadAll(resp.Body)
+	for _, sp := range s.Spec.Ports {
+		if sp.TargetPort.IntVal == int(dstPort.Port) {
+			return sp.Port, nil
+		}
+	}
+	return 0, fmt.Errorf("service %s does not expose port %d", s.Name, dstPort.Port)
+}
+
+func (ws *workspaceState) getService(namespace, name string) (*Service, error) {
 	var s Service
-	if err := json.Unmarshal(rd, &s); err != nil {
+	if err := ws.kubectlGet(namespace, "service", name, &s); err != nil {
 		return nil, err
 	}
 	return &s, nil
 }
 
-func (ws *workspaceState) createService(s *Service) error {
-	return ws.createObject(s)
+// kubectlGet gets the object of the given kind and name from the server and
+// unmarshals it into obj.  Cluster-wide objects are fetched with an empty
+// namespace, and every object of the kind is listed if name is empty.
+func (ws *workspaceState) kubectlGet(namespace, kind, name string, obj interface{}) error {
+	rd, err := ws.runKubeOp(kubeOp{Op: "get", Kind: kind, Name: name, Namespace: namespace})
+	// kubectl says "Error from server (NotFound): ... not found", or without
+	// the reason in older versions.
+	if err != nil && name != "" && (strings.Contains(err.Error(), "(NotFound)") || strings.HasSuffix(strings.TrimSpace(err.Error()), " not found")) {
+		return &notFoundError{kind: kind, name: name}
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(rd, obj)
 }
-func (ws *workspaceState) createObject(obj interface{}) error {
-	data, err := json.Marshal(obj)
+
+// notFoundError is returned by kubectlGet when the object it was asked for
+// doesn't exist.
+type notFoundError struct {
+	kind, name string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("%s %s not found", e.kind, e.name)
+}
+
+func isNotFound(err error) bool {
+	_, ok := err.(*notFoundError)
+	return ok
+}
+
+// runKubeOp runs op on the server, uploading objects for it to create or apply,
+// and returns kubectl's output.
+func (ws *workspaceState) runKubeOp(op kubeOp, objects ...interface{}) ([]byte, error) {
+	op.Cluster = ws.cluster.Name
+	opData, err := json.Marshal(op)
 	if err != nil {
-		return fmt.Errorf("unable to marshal object %T: %v", obj, err)
+		return nil, fmt.Errorf("unable to marshal operation: %v", err)
 	}
 	body := bytes.NewBuffer(nil)
 	var boundary string
 	{
 		mpw := multipart.NewWriter(body)
-		mwriter, err := mpw.CreateFormFile("file", "file.json")
-		if err != nil {
-			return fmt.Errorf("unable to create multipart writer: %v", err)
-		}
-		if _, err := io.Copy(mwriter, bytes.NewBuffer(data)); err != nil {
-			return fmt.Errorf("unable to write file to multipart writer: %v", err)
+		for i, obj := range objects {
+			data, err := json.Marshal(obj)
+			if err != nil {
+				return nil, fmt.Errorf("unable to marshal object %T: %v", obj, err)
+			}
+			mwriter, err := mpw.CreateFormFile("file", fmt.Sprintf("file%d.json", i))
+			if err != nil {
+				return nil, fmt.Errorf("unable to create multipart writer: %v", err)
+			}
+			if _, err := io.Copy(mwriter, bytes.NewBuffer(data)); err != nil {
+				return nil, fmt.Errorf("unable to write file to multipart writer: %v", err)
+			}
 		}
-		w, err := mpw.CreateFormField("cmd")
+		w, err := mpw.CreateFormField("op")
 		if err != nil {
-			return fmt.Errorf("unable to create kubeclt command to multipart writer: %v", err)
+			return nil, fmt.Errorf("unable to create kubectl operation in multipart writer: %v", err)
 		}
-		if _, err := io.Copy(w, bytes.NewBufferString("create -f file.json")); err != nil {
-			return fmt.Errorf("unable to write kubeclt command to multipart writer: %v", err)
+		if _, err := io.Copy(w, bytes.NewBuffer(opData)); err != nil {
+			return nil, fmt.Errorf("unable to write kubectl operation to multipart writer: %v", err)
 		}
 		boundary = mpw.Boundary()
 		if err := mpw.Close(); err != nil {
-			return fmt.Errorf("error closing multipart writer: %v", err)
+			return nil, fmt.Errorf("error closing multipart writer: %v", err)
 		}
 	}
 
@@ -447,15 +888,48 @@ func (ws *workspaceState) createObject(obj interface{}) error {
 	req.Header.Set("Content-Type", fmt.Sprintf("multipart/form-data; boundary=%s", boundary))
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to run remote kubectl: %v", err)
+		return nil, fmt.Errorf("failed to run remote kubectl: %v", err)
 	}
 	rd, _ := ioutil.ReadAll(resp.Body)
 	if len(rd) >= 4 && string(rd[0:4]) == "FAIL" {
-		SetToast("toaster", ToastError, fmt.Sprintf("%s", rd))
-	} else {
-		SetToast("toaster", ToastSuccess, fmt.Sprintf("Woot: %s", rd))
+		return nil, fmt.Errorf("%s", rd)
 	}
+	return rd, nil
+}
 
+// serviceName returns the name of the Service for p.
+func (ws *workspaceState) serviceName(p *pod) string {
+	if p.ext != nil {
+		if p.ext.service != "" {
+			return p.ext.service
+		}
+		return p.ext.publish
+	}
+	if p.imported != nil && p.imported.service != nil {
+		return p.imported.service.Name
+	}
+	return makeNiceName(p.manifest.Name.String())
+}
+
+func (ws *workspaceState) createService(s *Service) error {
+	return ws.createObject(s)
+}
+func (ws *workspaceState) createObject(obj interface{}) error {
+	rd, err := ws.runKubeOp(kubeOp{Op: "create"}, obj)
+	if err != nil {
+		return err
+	}
+	SetToast("toaster", ToastSuccess, fmt.Sprintf("Woot: %s", rd))
+	return nil
+}
+
+// applyObject is createObject for objects that may already exist.
+func (ws *workspaceState) applyObject(obj interface{}) error {
+	rd, err := ws.runKubeOp(kubeOp{Op: "apply"}, obj)
+	if err != nil {
+		return err
+	}
+	SetToast("toaster", ToastSuccess, fmt.Sprintf("Woot: %s", rd))
 	return nil
 }
 
@@ -463,6 +937,34 @@ type edge struct {
 	src, dst *podAnchor
 	temp     point
 	complete bool
+
+	// If non-zero, port pins the service port used for this edge rather than
+	// letting the service pick one.
+	port int
+}
+
+func (e *edge) midpoint() point {
+	src := point{e.src.pod.x + e.src.edgePt.x, e.src.pod.y + e.src.edgePt.y}
+	dst := e.temp
+	if e.dst != nil {
+		dst = point{e.dst.pod.x + e.dst.edgePt.x, e.dst.pod.y + e.dst.edgePt.y}
+	}
+	return point{(src.x + dst.x) / 2, (src.y + dst.y) / 2}
+}
+
+// Pin sets the service port used for this edge, a port of 0 unpins it.
+func (e *edge) Pin(port int) error {
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("port %d is out of range", port)
+	}
+	if rf, ok := e.src.obj.(*requiredFlag); !ok || rf.typ != "host-port" {
+		return fmt.Errorf("only host-port edges can have their port pinned")
+	}
+	if _, ok := e.dst.obj.(*externalObj); ok {
+		return fmt.Errorf("the port of an external endpoint can't be pinned")
+	}
+	e.port = port
+	return nil
 }
 
 func (e *edge) Check() error {
@@ -478,13 +980,14 @@ func (e *edge) Check() error {
 
 	if rf, ok := e.src.obj.(*requiredFlag); ok {
 		if rf.typ == "host-port" {
-			if _, ok := e.dst.obj.(*types.Port); ok {
+			switch e.dst.obj.(type) {
+			case *types.Port, *externalObj:
 				return nil
 			}
 		}
 	}
 
-	if _, ok := e.src.obj.(portObj); ok {
+	if _, ok := e.src.obj.(*portObj); ok {
 		if _, ok := e.dst.obj.(*types.Port); ok {
 			return nil
 		}
@@ -503,7 +1006,35 @@ type pod struct {
 	// Exactly one of the following should be non-zero
 	manifest *schema.ImageManifest
 	disk     string
-	port     int
+	ingress  *portObj
+	ext      *externalObj
+
+	// If set, namespace overrides the workspace's namespace for this node.
+	namespace string
+
+	// signature is how the server verified the image of a container.
+	signature signatureInfo
+
+	// layers is the dependency tree of a container's image.
+	layers []layerInfo
+
+	// image is what the cluster should pull to run a container, and if
+	// undeployable is set it's why there's nothing the cluster can pull.
+	image        string
+	undeployable string
+
+	// source is the name the image was added by, and platform is the os and
+	// arch it was discovered for.
+	source   string
+	platform platform
+
+	// events are what the cluster has reported about a deployed container.
+	events []flowEvent
+
+	// imported is set if the node was imported from the cluster, and volume
+	// is the source of an imported disk, which is otherwise a GCE disk.
+	imported *importedNode
+	volume   *VolumeSource
 
 	selected     bool
 	selectTime   time.Time
@@ -526,9 +1057,9 @@ type podAnchor struct {
 	// requiredFlag
 	// diskObj
 	// portObj
+	// externalObj
 }
 type diskObj string
-type portObj int
 
 var requiredFlagNameRe = regexp.MustCompile(`required-flag/(.*)`)
 var requiredFlagValueRe = regexp.MustCompile(`name=(.*);type=(.*)`)
@@ -668,25 +1199,46 @@ func MakeDisk(name string, ctx *js.Object) *pod {
 	return p
 }
 
-func MakeIngress(port int, ctx *js.Object) *pod {
+func MakeIngress(po *portObj, ctx *js.Object) *pod {
 	p := &pod{
-		port: port,
-		x:    10,
-		y:    10,
-		dx:   100,
-		dy:   100,
+		ingress: po,
+		x:       10,
+		y:       10,
+		dx:      100,
+		dy:      100,
+	}
+	ctx.Set("font", "15px Monaco")
+	if width := ctx.Call("measureText", po.String()).Get("width").Int() + 20; width > p.dx {
+		p.dx = width
 	}
 	p.anchors = append(p.anchors, &podAnchor{
 		pod:    p,
 		text:   "",
-		edgePt: point{50, 100},
-		textPt: point{50, 100 - 12},
-		obj:    portObj(port),
+		edgePt: point{p.dx / 2, 100},
+		textPt: point{p.dx / 2, 100 - 12},
+		obj:    po,
 	})
 
 	return p
 }
 
+// external returns true if p was imported and hasn't been adopted, so it isn't
+// deployed by flow.
+func (p *pod) external() bool {
+	return p.imported != nil && !p.imported.adopted
+}
+
+// brokenLayers returns how many of the layers of p couldn't be resolved.
+func (p *pod) brokenLayers() int {
+	n := 0
+	for _, layer := range p.layers {
+		if layer.Error != "" {
+			n++
+		}
+	}
+	return n
+}
+
 func (p *pod) Click(pt point) {
 	p.drag = pt
 	p.origin = point{p.x, p.y}
@@ -734,8 +1286,12 @@ func (p *pod) Draw(ctx *js.Object) {
 	switch {
 	case p.disk != "":
 		ctx.Set("fillStyle", "rgb(225, 225, 225)")
-	case p.port != 0:
+	case p.ingress != nil:
 		ctx.Set("fillStyle", "rgb(195, 240, 215)")
+	case p.ext != nil:
+		ctx.Set("fillStyle", "rgb(240, 230, 205)")
+	case p.external():
+		ctx.Set("fillStyle", "rgb(240, 230, 205)")
 	case p.manifest != nil:
 		ctx.Set("fillStyle", "rgb(220, 220, 240)")
 	default:
@@ -749,10 +1305,57 @@ func (p *pod) Draw(ctx *js.Object) {
 	switch {
 	case p.manifest != nil:
 		ctx.Call("fillText", p.manifest.Name, p.x+p.dx/2, p.y+p.dy/2)
+		var notes []string
+		if p.namespace != "" {
+			notes = append(notes, p.namespace)
+		}
+		if p.platform != defaultPlatform {
+			notes = append(notes, p.platform.String())
+		}
+		if len(notes) > 0 {
+			ctx.Call("fillText", fmt.Sprintf("(%s)", strings.Join(notes, ", ")), p.x+p.dx/2, p.y+p.dy/2+18)
+		}
+		if p.brokenLayers() > 0 {
+			ctx.Set("fillStyle", "rgb(200, 0, 0)")
+			ctx.Call("fillText", fmt.Sprintf("(%d missing dependencies)", p.brokenLayers()), p.x+p.dx/2, p.y+p.dy/2+36)
+			ctx.Set("fillStyle", "rgb(0, 0, 0)")
+		}
+		if p.external() {
+			ctx.Call("fillText", "(external)", p.x+p.dx/2, p.y+p.dy/2-18)
+		} else if p.undeployable != "" {
+			ctx.Set("fillStyle", "rgb(200, 0, 0)")
+			ctx.Call("fillText", "(not deployable)", p.x+p.dx/2, p.y+p.dy/2-18)
+			ctx.Set("fillStyle", "rgb(0, 0, 0)")
+		} else if p.imported != nil {
+			ctx.Call("fillText", "(adopted)", p.x+p.dx/2, p.y+p.dy/2-18)
+		} else if p.signature.pending() {
+			ctx.Call("fillText", "(checking signature)", p.x+p.dx/2, p.y+p.dy/2-18)
+		} else if !p.signature.verified() {
+			ctx.Set("fillStyle", "rgb(200, 0, 0)")
+			ctx.Call("fillText", fmt.Sprintf("(%s image)", p.signature.Status), p.x+p.dx/2, p.y+p.dy/2-18)
+			ctx.Set("fillStyle", "rgb(0, 0, 0)")
+		}
+		if n := p.warnings(); n > 0 {
+			ctx.Set("fillStyle", "rgb(200, 0, 0)")
+			ctx.Call("beginPath")
+			ctx.Call("arc", p.x+p.dx-2, p.y+2, 11, 0, 7)
+			ctx.Call("fill")
+			ctx.Set("fillStyle", "rgb(255, 255, 255)")
+			ctx.Set("font", "bold 12px Monaco")
+			ctx.Call("fillText", fmt.Sprintf("%d", n), p.x+p.dx-2, p.y+6)
+			ctx.Set("font", "15px Monaco")
+			ctx.Set("fillStyle", "rgb(0, 0, 0)")
+		}
 	case p.disk != "":
 		ctx.Call("fillText", p.disk, p.x+p.dx/2, p.y+p.dy/2)
-	case p.port > 0:
-		ctx.Call("fillText", fmt.Sprintf("port %d", p.port), p.x+p.dx/2, p.y+p.dy/2)
+	case p.ingress != nil:
+		ctx.Call("fillText", p.ingress.String(), p.x+p.dx/2, p.y+p.dy/2)
+	case p.ext != nil:
+		ctx.Call("fillText", p.ext.String(), p.x+p.dx/2, p.y+p.dy/2)
+		ctx.Call("fillText", "(external)", p.x+p.dx/2, p.y+p.dy/2-18)
+		if p.namespace != "" {
+			ctx.Call("fillText", fmt.Sprintf("(%s)", p.namespace), p.x+p.dx/2, p.y+p.dy/2+18)
+		}
 	}
 
 	for _, anchor := range p.anchors {
@@ -763,7 +1366,25 @@ func (p *pod) Draw(ctx *js.Object) {
 	}
 }
 
-func (w *Workspace) Images() chan<- schema.ImageManifest {
+// awaitSignature asks the server for the image called name, built for pl, until
+// it has finished downloading it, and then hands p the image's signature and
+// dependencies.
+func (w *Workspace) awaitSignature(p *pod, name string, pl platform) {
+	for {
+		time.Sleep(2 * time.Second)
+		info, err := fetchImage(name, pl)
+		if err != nil {
+			SetToast("toaster", ToastError, fmt.Sprintf("Unable to check the signature of %s: %v", name, err))
+			return
+		}
+		if !info.Signature.pending() {
+			w.signatures <- nodePlatform{pod: p, platform: pl, info: info}
+			return
+		}
+	}
+}
+
+func (w *Workspace) Images() chan<- containerInfo {
 	return w.images
 }
 
@@ -771,16 +1392,54 @@ func (w *Workspace) Disks() chan<- string {
 	return w.disks
 }
 
-func (w *Workspace) Ingresses() chan<- int {
+func (w *Workspace) Ingresses() chan<- *portObj {
 	return w.ingresses
 }
 
+func (w *Workspace) Externals() chan<- externalNode {
+	return w.externals
+}
+
+func (w *Workspace) Namespaces() chan<- namespaceSetting {
+	return w.namespaces
+}
+
+func (w *Workspace) Clusters() chan<- clusterTarget {
+	return w.clusters
+}
+
+func (w *Workspace) PinPorts() chan<- int {
+	return w.pinPorts
+}
+
+// Import adds the services and replication controllers in namespace, or in the
+// workspace's namespace if it's empty, to the workspace.
+func (w *Workspace) Import(namespace string) {
+	go func() {
+		w.importNS <- namespace
+	}()
+}
+
 func (w *Workspace) MakeItSo() {
 	go func() {
 		w.makeItSo <- struct{}{}
 	}()
 }
 
+// SetWorkspaceID changes the workspace id that objects are labelled with, and
+// that Tear Down deletes objects by.
+func (w *Workspace) SetWorkspaceID(id string) {
+	go func() {
+		w.workspaceIDs <- id
+	}()
+}
+
+func (w *Workspace) TearDown(keepData bool) {
+	go func() {
+		w.tearDown <- keepData
+	}()
+}
+
 func (w *Workspace) Cut() {
 	go func() {
 		w.cut <- struct{}{}
@@ -811,6 +1470,10 @@ func (w *Workspace) getEventPosition(e *js.Object) (x, y, cx, cy int, in bool) {
 }
 
 func (w *Workspace) onMouseDown(this *js.Object, args []*js.Object) interface{} {
+	if w.inMenu(args[0]) {
+		return nil
+	}
+	w.hideMenu()
 	x, y, _, _, _ := w.getEventPosition(args[0])
 	go func() {
 		w.mouseDown <- point{x, y}
@@ -826,6 +1489,15 @@ func (w *Workspace) onMouseMove(this *js.Object, args []*js.Object) interface{}
 	return nil
 }
 
+func (w *Workspace) onContextMenu(this *js.Object, args []*js.Object) interface{} {
+	args[0].Call("preventDefault")
+	x, y, _, _, _ := w.getEventPosition(args[0])
+	go func() {
+		w.contextMenu <- point{x, y}
+	}()
+	return nil
+}
+
 func (w *Workspace) onMouseUp(this *js.Object, args []*js.Object) interface{} {
 	x, y, _, _, _ := w.getEventPosition(args[0])
 	go func() {
@@ -844,9 +1516,12 @@ func (w *Workspace) doDraw(state *workspaceState) {
 		edges = append(edges, state.connect)
 	}
 	for _, e := range edges {
-		if e.complete {
+		switch {
+		case e == state.selectedEdge:
+			w.ctx.Set("strokeStyle", "rgb(0, 0, 255)")
+		case e.complete:
 			w.ctx.Set("strokeStyle", "rgb(0, 0, 0)")
-		} else {
+		default:
 			w.ctx.Set("strokeStyle", "rgb(0, 255, 0)")
 		}
 		w.ctx.Call("beginPath")
@@ -857,5 +1532,16 @@ func (w *Workspace) doDraw(state *workspaceState) {
 			w.ctx.Call("lineTo", e.temp.x, e.temp.y)
 		}
 		w.ctx.Call("stroke")
+		if e.complete {
+			mid := e.midpoint()
+			w.ctx.Set("fillStyle", w.ctx.Get("strokeStyle"))
+			w.ctx.Call("beginPath")
+			w.ctx.Call("arc", mid.x, mid.y, 3, 0, 7)
+			w.ctx.Call("fill")
+			if e.port != 0 {
+				w.ctx.Set("textAlign", "left")
+				w.ctx.Call("fillText", fmt.Sprintf(":%d", e.port), mid.x+6, mid.y)
+			}
+		}
 	}
 }
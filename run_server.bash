@@ -1,8 +1,8 @@
 set -e
 
-mkdir -p server/_html
-gopherjs build -m -o server/_html/frontend.js github.com/runningwild/flow/frontend
-cp frontend/index.html server/_html/index.html
-cd server
-# go run main.go --kubectl /Users/jwills/google-cloud-sdk/bin/kubectl
-go run main.go
+# Build the frontend into server/_html, where it's embedded in the server.
+go generate ./server
+# Settings can also come from a config file, see server/flow.example.json:
+# go run ./server --config server/flow.example.json
+# Add --static-dir server/_html to serve the UI from disk while working on it.
+go run ./server "$@"
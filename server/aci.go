@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path"
+)
+
+// maxManifestSize is the largest manifest that will be read out of an image.
+const maxManifestSize = 1 << 20
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// errTooLarge is returned when a download is larger than it's allowed to be.
+type errTooLarge struct {
+	limit int64
+}
+
+func (e errTooLarge) Error() string {
+	return fmt.Sprintf("download is larger than the %d byte limit", e.limit)
+}
+
+// limitedReader is like io.LimitedReader, except that it fails once the limit
+// is exceeded rather than quietly stopping.
+type limitedReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.n += int64(n)
+	if lr.n > lr.limit {
+		return n, errTooLarge{lr.limit}
+	}
+	return n, err
+}
+
+// decompress detects whether r is gzip, bzip2 or xz compressed and returns a
+// reader for the decompressed stream.  Anything else is assumed to be an
+// uncompressed tar.  The returned reader must be closed.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("unable to read image: %v", err)
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+
+	case bytes.HasPrefix(magic, xzMagic):
+		// Like the appc tools, rely on the xz binary rather than a go
+		// implementation.
+		cmd := exec.Command("xz", "--decompress", "--stdout")
+		cmd.Stdin = br
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("unable to run xz: %v", err)
+		}
+		return &cmdReader{ReadCloser: out, cmd: cmd}, nil
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// cmdReader reads the output of a command, killing it when closed in case it
+// hasn't finished.
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (cr *cmdReader) Close() error {
+	cr.ReadCloser.Close()
+	cr.cmd.Process.Kill()
+	cr.cmd.Wait()
+	return nil
+}
+
+// readManifest reads the tar in the possibly compressed image r until it
+// finds the manifest, so that only as much of the image as comes before the
+// manifest is ever read.
+func readManifest(r io.Reader) ([]byte, error) {
+	dr, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	tr := tar.NewReader(dr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("image does not contain a manifest")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read image: %v", err)
+		}
+		if path.Clean(header.Name) != "manifest" {
+			continue
+		}
+		manifest, err := ioutil.ReadAll(&limitedReader{r: tr, limit: maxManifestSize})
+		if err != nil {
+			return nil, fmt.Errorf("unable to read manifest: %v", err)
+		}
+		return manifest, nil
+	}
+}
+
+// manifestWriter hands what's written to it to the reader of pw, which is
+// looking for the manifest, until that reader closes the pipe.  Everything
+// after that is dropped, so that the rest of a download carries on without it.
+type manifestWriter struct {
+	pw     *io.PipeWriter
+	closed bool
+}
+
+func (mw *manifestWriter) Write(p []byte) (int, error) {
+	if !mw.closed {
+		if _, err := mw.pw.Write(p); err != nil {
+			mw.closed = true
+		}
+	}
+	return len(p), nil
+}
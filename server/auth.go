@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// tokenCookie is where the browser keeps the token of a user that logged in by
+// visiting any page with ?token=<token>.
+const tokenCookie = "flow-token"
+
+// errUnauthenticated is returned by authenticators when the request carries
+// no credentials at all, as opposed to bad ones.
+var errUnauthenticated = fmt.Errorf("no credentials given")
+
+// authenticator works out which user made a request.
+type authenticator interface {
+	authenticate(w http.ResponseWriter, r *http.Request) (string, error)
+
+	// challenge asks the client for credentials after authenticate fails.
+	challenge(w http.ResponseWriter)
+}
+
+// newAuthenticator returns the authenticator for mode, configured from the
+// given file or header.
+func newAuthenticator(mode, tokens, htpasswd, header string, proxies []string) (authenticator, error) {
+	switch mode {
+	case "none":
+		return noAuth{}, nil
+	case "token":
+		return loadTokens(tokens)
+	case "htpasswd":
+		return loadHtpasswd(htpasswd)
+	case "proxy":
+		return newProxyAuth(header, proxies)
+	}
+	return nil, fmt.Errorf("unknown authentication mode %q, must be one of none, token, htpasswd or proxy", mode)
+}
+
+// noAuth lets everyone in as the same anonymous user.
+type noAuth struct{}
+
+func (noAuth) authenticate(w http.ResponseWriter, r *http.Request) (string, error) {
+	return "anonymous", nil
+}
+
+func (noAuth) challenge(w http.ResponseWriter) {}
+
+// tokenAuth accepts static bearer tokens, each of which belongs to a user.
+type tokenAuth struct {
+	tokens map[string]string
+}
+
+// loadTokens reads a file with one "<token> <user>" pair per line.  Blank lines
+// and lines starting with # are ignored.
+func loadTokens(path string) (*tokenAuth, error) {
+	if path == "" {
+		return nil, fmt.Errorf("token authentication requires --auth-tokens")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read tokens: %v", err)
+	}
+	defer f.Close()
+	ta := &tokenAuth{tokens: make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<token> <user>\"", path, line)
+		}
+		ta.tokens[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read tokens: %v", err)
+	}
+	log.Printf("Loaded %d tokens from %s", len(ta.tokens), path)
+	return ta, nil
+}
+
+func (ta *tokenAuth) authenticate(w http.ResponseWriter, r *http.Request) (string, error) {
+	token := ""
+	fromQuery := false
+	switch {
+	case strings.HasPrefix(r.Header.Get("Authorization"), "Bearer "):
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	case r.URL.Query().Get("token") != "":
+		token = r.URL.Query().Get("token")
+		fromQuery = true
+	default:
+		if c, err := r.Cookie(tokenCookie); err == nil {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		return "", errUnauthenticated
+	}
+	// Compare against every token so that the time taken doesn't give away
+	// how much of a token was right.
+	user := ""
+	for t, u := range ta.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			user = u
+		}
+	}
+	if user == "" {
+		return "", fmt.Errorf("invalid token")
+	}
+	if fromQuery {
+		http.SetCookie(w, &http.Cookie{
+			Name:     tokenCookie,
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	return user, nil
+}
+
+func (ta *tokenAuth) challenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="flow"`)
+}
+
+// htpasswdAuth does http basic auth against an htpasswd file.  Only bcrypt
+// and {SHA} hashes are supported.
+type htpasswdAuth struct {
+	users map[string]string
+}
+
+func loadHtpasswd(path string) (*htpasswdAuth, error) {
+	if path == "" {
+		return nil, fmt.Errorf("htpasswd authentication requires --htpasswd")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read htpasswd file: %v", err)
+	}
+	ha := &htpasswdAuth{users: make(map[string]string)}
+	for i, text := range strings.Split(string(data), "\n") {
+		text = strings.TrimSpace(text)
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<user>:<hash>\"", path, i+1)
+		}
+		hash := parts[1]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s:%d: unsupported hash for %s, use htpasswd -B", path, i+1, parts[0])
+		}
+		ha.users[parts[0]] = hash
+	}
+	log.Printf("Loaded %d users from %s", len(ha.users), path)
+	return ha, nil
+}
+
+func (ha *htpasswdAuth) authenticate(w http.ResponseWriter, r *http.Request) (string, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", errUnauthenticated
+	}
+	hash, ok := ha.users[user]
+	if !ok {
+		return "", fmt.Errorf("unknown user %s", user)
+	}
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(pass))
+		want := strings.TrimPrefix(hash, "{SHA}")
+		if subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(want)) != 1 {
+			return "", fmt.Errorf("wrong password for %s", user)
+		}
+		return user, nil
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)); err != nil {
+		return "", fmt.Errorf("wrong password for %s", user)
+	}
+	return user, nil
+}
+
+func (ha *htpasswdAuth) challenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="flow"`)
+}
+
+// proxyAuth trusts a header set by a reverse proxy that has already
+// authenticated the user.  The header is only believed when the request comes
+// from one of the trusted proxies.
+type proxyAuth struct {
+	header  string
+	trusted []*net.IPNet
+}
+
+func newProxyAuth(header string, proxies []string) (*proxyAuth, error) {
+	if header == "" {
+		return nil, fmt.Errorf("proxy authentication requires --auth-header")
+	}
+	pa := &proxyAuth{header: header}
+	for _, cidr := range proxies {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", cidr, err)
+		}
+		pa.trusted = append(pa.trusted, ipnet)
+	}
+	if len(pa.trusted) == 0 {
+		return nil, fmt.Errorf("proxy authentication requires at least one --trusted-proxies")
+	}
+	return pa, nil
+}
+
+func (pa *proxyAuth) authenticate(w http.ResponseWriter, r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse remote address %q", r.RemoteAddr)
+	}
+	ip := net.ParseIP(host)
+	trusted := false
+	for _, ipnet := range pa.trusted {
+		if ip != nil && ipnet.Contains(ip) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return "", fmt.Errorf("request from %s did not come through a trusted proxy", host)
+	}
+	user := r.Header.Get(pa.header)
+	if user == "" {
+		return "", errUnauthenticated
+	}
+	return user, nil
+}
+
+func (pa *proxyAuth) challenge(w http.ResponseWriter) {}
+
+// permission is what a user is allowed to do.  Any list may contain "*" to
+// allow anything.
+type permission struct {
+	// Clusters the user may use, every cluster if this is empty.
+	Clusters []string `json:"clusters,omitempty"`
+
+	// Namespaces the user may work in.
+	Namespaces []string `json:"namespaces"`
+
+	// Operations are the kubectl verbs the user may run, e.g. get, create or
+	// delete.
+	Operations []string `json:"operations"`
+}
+
+// permissions maps users to what they're allowed to do.  Users that aren't
+// listed get Default, or nothing if there's no default.
+type permissions struct {
+	Users   map[string]*permission `json:"users"`
+	Default *permission            `json:"default,omitempty"`
+}
+
+// loadPermissions reads a json permissions file.  Without one every user may
+// do everything.
+func loadPermissions(path string) (*permissions, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read permissions: %v", err)
+	}
+	var perms permissions
+	if err := json.Unmarshal(data, &perms); err != nil {
+		return nil, fmt.Errorf("unable to parse permissions in %s: %v", path, err)
+	}
+	log.Printf("Loaded permissions for %d users from %s", len(perms.Users), path)
+	return &perms, nil
+}
+
+func contains(list []string, val string) bool {
+	for _, v := range list {
+		if v == "*" || v == val {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns user's permissions, which is nil if they may do nothing.
+func (ps *permissions) lookup(user string) *permission {
+	if perm := ps.Users[user]; perm != nil {
+		return perm
+	}
+	return ps.Default
+}
+
+// allowsCluster returns true if user may use the cluster called name.
+func (ps *permissions) allowsCluster(user, name string) bool {
+	if ps == nil {
+		return true
+	}
+	perm := ps.lookup(user)
+	return perm != nil && (len(perm.Clusters) == 0 || contains(perm.Clusters, name))
+}
+
+// check returns an error unless user may run op in namespace on cluster.
+// Cluster-wide objects have an empty namespace, reading them only needs
+// permission for the operation but changing them needs permission for every
+// namespace.
+func (ps *permissions) check(user, cluster, op, namespace string) error {
+	if ps == nil {
+		return nil
+	}
+	perm := ps.lookup(user)
+	if perm == nil {
+		return fmt.Errorf("%s has no permissions", user)
+	}
+	if !ps.allowsCluster(user, cluster) {
+		return fmt.Errorf("%s may not use cluster %s", user, cluster)
+	}
+	if !contains(perm.Operations, op) {
+		return fmt.Errorf("%s may not %s", user, op)
+	}
+	switch {
+	case namespace == "" && op == "get":
+	case namespace == "" && !contains(perm.Namespaces, "*"):
+		return fmt.Errorf("%s may not %s cluster-wide objects", user, op)
+	case namespace != "" && !contains(perm.Namespaces, namespace):
+		return fmt.Errorf("%s may not %s in namespace %s", user, op, namespace)
+	}
+	return nil
+}
+
+// sameOrigin returns an error unless r came from a page we served or from an
+// allowed origin.  Requests without an Origin aren't from a browser, or are
+// same-origin GETs, so they're let through.
+func (s *server) sameOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if u.Host == r.Host {
+		return nil
+	}
+	for _, o := range s.allowedOrigins {
+		if o == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %s is not allowed", origin)
+}
+
+// allowOrigin sets the CORS headers for requests from an allowed origin.  The
+// UI is served by this server so cross-origin requests are refused unless an
+// origin has been explicitly allowed.
+func (s *server) allowOrigin(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	allowed := false
+	for _, o := range s.allowedOrigins {
+		if o == origin {
+			allowed = true
+		}
+	}
+	if origin == "" || !allowed {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Add("Vary", "Origin")
+}
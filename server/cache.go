@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// imageCache is an on-disk, content-addressed cache of images and signatures.
+// Blobs are stored by their sha512, which for images is the same as their
+// appc image ID, and apps are indexed by the name and labels they were
+// discovered with so that they can be revalidated or used while the registry
+// can't be reached.
+type imageCache struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	index cacheIndex
+
+	// downloads are the images still being brought into the cache, by url.
+	downloads map[string]*download
+}
+
+type cacheIndex struct {
+	Apps  map[string]*cachedApp  `json:"apps"`
+	Blobs map[string]*cachedBlob `json:"blobs"`
+}
+
+// cachedApp is what was last fetched for an app.
+type cachedApp struct {
+	URL          string   `json:"url"`
+	ImageID      string   `json:"imageID"`
+	SignatureID  string   `json:"signatureID,omitempty"`
+	Pubkeys      []string `json:"pubkeys,omitempty"`
+	ETag         string   `json:"etag,omitempty"`
+	LastModified string   `json:"lastModified,omitempty"`
+
+	// download is set while the image is still being brought into the
+	// cache, until then there's no ImageID or SignatureID.
+	download *download
+}
+
+// download is an image whose manifest has been read from the front of it while
+// the rest of it is still being brought into the cache.  Once done is closed
+// either entry or err is set.
+type download struct {
+	manifest json.RawMessage
+	done     chan struct{}
+	entry    *cachedApp
+	err      error
+}
+
+// wait blocks until the download has finished and returns what was cached.
+func (dl *download) wait() (*cachedApp, error) {
+	<-dl.done
+	return dl.entry, dl.err
+}
+
+// finished returns true once wait won't block.
+func (dl *download) finished() bool {
+	select {
+	case <-dl.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// manifest returns the manifest read from the front of entry's image while
+// it's still downloading, or nil.
+func (entry *cachedApp) manifest() json.RawMessage {
+	if entry.download == nil {
+		return nil
+	}
+	return entry.download.manifest
+}
+
+// settled returns entry with what its download cached filled in, or entry
+// itself if there's no download or it hasn't finished.
+func (entry *cachedApp) settled() (*cachedApp, error) {
+	if entry.download == nil || !entry.download.finished() {
+		return entry, nil
+	}
+	done, err := entry.download.wait()
+	if err != nil {
+		return nil, err
+	}
+	cp := *done
+	cp.Pubkeys = entry.Pubkeys
+	return &cp, nil
+}
+
+type cachedBlob struct {
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"lastUsed"`
+
+	// For images, Manifest is the image's manifest once it has been read.
+	Manifest json.RawMessage `json:"manifest,omitempty"`
+}
+
+// openImageCache opens the cache in dir, creating it if necessary.  The cache
+// evicts the least recently used blobs once it holds more than maxSize bytes.
+func openImageCache(dir string, maxSize int64) (*imageCache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0700); err != nil {
+		return nil, fmt.Errorf("unable to create image cache in %s: %v", dir, err)
+	}
+	c := &imageCache{
+		dir:     dir,
+		maxSize: maxSize,
+		index: cacheIndex{
+			Apps:  make(map[string]*cachedApp),
+			Blobs: make(map[string]*cachedBlob),
+		},
+		downloads: make(map[string]*download),
+	}
+	data, err := ioutil.ReadFile(c.indexPath())
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read image cache index: %v", err)
+	}
+	if err := json.Unmarshal(data, &c.index); err != nil {
+		log.Printf("Discarding corrupt image cache index: %v", err)
+		c.index.Apps = make(map[string]*cachedApp)
+		c.index.Blobs = make(map[string]*cachedBlob)
+	}
+	return c, nil
+}
+
+func (c *imageCache) indexPath() string {
+	return filepath.Join(c.dir, "index.json")
+}
+
+func (c *imageCache) blobPath(id string) string {
+	return filepath.Join(c.dir, "blobs", id)
+}
+
+// save writes the index to disk.  c.mu must be held.
+func (c *imageCache) save() error {
+	data, err := json.MarshalIndent(c.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.indexPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("unable to write image cache index: %v", err)
+	}
+	return os.Rename(tmp, c.indexPath())
+}
+
+// lookup returns the cached entry for app, or nil if there isn't one or its
+// image has since been evicted.
+func (c *imageCache) lookup(app string) *cachedApp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.index.Apps[app]
+	if !ok || c.index.Blobs[entry.ImageID] == nil {
+		return nil
+	}
+	cp := *entry
+	return &cp
+}
+
+// setApp records entry as the latest version of app.
+func (c *imageCache) setApp(app string, entry *cachedApp) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cp := *entry
+	c.index.Apps[app] = &cp
+	return c.save()
+}
+
+// downloading returns the download of url that's in progress, if there is one.
+func (c *imageCache) downloading(url string) *download {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.downloads[url]
+}
+
+// startedDownload records that the download of url, whose manifest has been
+// read, is in progress unless it has already finished.
+func (c *imageCache) startedDownload(url string, dl *download, manifest json.RawMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dl.manifest = manifest
+	if !dl.finished() {
+		c.downloads[url] = dl
+	}
+}
+
+// finishDownload records what the download of url cached, or why it failed.
+func (c *imageCache) finishDownload(url string, dl *download, entry *cachedApp, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.downloads[url] == dl {
+		delete(c.downloads, url)
+	}
+	if blob, ok := c.index.Blobs[entry.ImageID]; ok && err == nil && blob.Manifest == nil && dl.manifest != nil {
+		blob.Manifest = dl.manifest
+		if err := c.save(); err != nil {
+			log.Printf("Unable to save image cache index: %v", err)
+		}
+	}
+	dl.entry, dl.err = entry, err
+	close(dl.done)
+}
+
+// store copies r into the cache and returns its id.  It fails if r holds more
+// than limit bytes.
+func (c *imageCache) store(r io.Reader, limit int64) (string, error) {
+	f, err := ioutil.TempFile(c.dir, "download-")
+	if err != nil {
+		return "", fmt.Errorf("unable to create temporary file in image cache: %v", err)
+	}
+	defer os.Remove(f.Name())
+	h := sha512.New()
+	size, err := io.Copy(io.MultiWriter(f, h), &limitedReader{r: r, limit: limit})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to write to image cache: %v", err)
+	}
+	id := "sha512-" + hex.EncodeToString(h.Sum(nil))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(f.Name(), c.blobPath(id)); err != nil {
+		return "", fmt.Errorf("unable to add %s to image cache: %v", id, err)
+	}
+	blob, ok := c.index.Blobs[id]
+	if !ok {
+		blob = &cachedBlob{Size: size}
+		c.index.Blobs[id] = blob
+	}
+	blob.LastUsed = time.Now()
+	c.evict(id)
+	return id, c.save()
+}
+
+// open returns the blob with the given id.
+func (c *imageCache) open(id string) (*os.File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	blob, ok := c.index.Blobs[id]
+	if !ok {
+		return nil, fmt.Errorf("%s is not in the image cache", id)
+	}
+	blob.LastUsed = time.Now()
+	return os.Open(c.blobPath(id))
+}
+
+// readAll returns the contents of the blob with the given id.
+func (c *imageCache) readAll(id string) ([]byte, error) {
+	f, err := c.open(id)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// manifest returns the manifest of the image with the given id, reading it out
+// of the image the first time it's asked for.
+func (c *imageCache) manifest(id string) ([]byte, error) {
+	c.mu.Lock()
+	blob, ok := c.index.Blobs[id]
+	if ok && blob.Manifest != nil {
+		blob.LastUsed = time.Now()
+		c.mu.Unlock()
+		return blob.Manifest, nil
+	}
+	c.mu.Unlock()
+
+	f, err := c.open(id)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readManifest(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if blob, ok := c.index.Blobs[id]; ok {
+		blob.Manifest = manifest
+		if err := c.save(); err != nil {
+			log.Printf("Unable to save image cache index: %v", err)
+		}
+	}
+	return manifest, nil
+}
+
+// evict removes the least recently used blobs, other than keep, until the
+// cache fits in maxSize.  c.mu must be held.
+func (c *imageCache) evict(keep string) {
+	var total int64
+	var ids []string
+	for id, blob := range c.index.Blobs {
+		total += blob.Size
+		if id != keep {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return c.index.Blobs[ids[i]].LastUsed.Before(c.index.Blobs[ids[j]].LastUsed)
+	})
+	for _, id := range ids {
+		if total <= c.maxSize {
+			break
+		}
+		log.Printf("Evicting %s from image cache", id)
+		if err := os.Remove(c.blobPath(id)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Unable to remove %s: %v", id, err)
+			continue
+		}
+		total -= c.index.Blobs[id].Size
+		delete(c.index.Blobs, id)
+	}
+	for app, entry := range c.index.Apps {
+		if c.index.Blobs[entry.ImageID] == nil {
+			delete(c.index.Apps, app)
+		}
+	}
+}
+
+// fetchApp discovers app and brings its image and signature into the cache,
+// revalidating what's already there.  If the registry can't be reached then
+// whatever was last cached for app is used.  A new image is returned as soon as
+// its manifest has been read, while the rest of it is still downloading.
+func (s *server) fetchApp(app discoveryApp) (*cachedApp, error) {
+	key := app.String()
+	cached := s.cache.lookup(key)
+	// A source can have templates for app and still not have the image, e.g.
+	// a registry that holds other versions of it, so every source is tried
+	// until one of them has it.
+	var errs []string
+	for _, base := range s.discovery.sources() {
+		res, err := s.discovery.discoverFrom(base, app)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		for _, ep := range res.acis {
+			entry, err := s.fetchEndpoint(key, ep, res.pubkeys, cached)
+			if err != nil {
+				log.Printf("Unable to fetch image from %s: %v", ep.aci, err)
+				errs = append(errs, err.Error())
+				continue
+			}
+			return entry, nil
+		}
+	}
+	if cached != nil {
+		log.Printf("Using cached %s, fetching failed: %s", key, strings.Join(errs, "; "))
+		return cached, nil
+	}
+	return nil, fmt.Errorf("unable to fetch image: %s", strings.Join(errs, "; "))
+}
+
+// fetchEndpoint fetches the image and signature at ep for the app with the
+// given key, reusing cached if it is still valid.  A new image is downloaded in
+// the background, see startDownload.
+func (s *server) fetchEndpoint(key string, ep aciEndpoint, pubkeys []string, cached *cachedApp) (*cachedApp, error) {
+	if dl := s.cache.downloading(ep.aci); dl != nil {
+		return &cachedApp{URL: ep.aci, Pubkeys: pubkeys, download: dl}, nil
+	}
+	req, err := http.NewRequest("GET", ep.aci, nil)
+	if err != nil {
+		return nil, err
+	}
+	revalidate := cached != nil && cached.URL == ep.aci
+	if revalidate {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := s.discovery.client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("unable to find container: %v", err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		if resp.ContentLength > s.maxImageSize {
+			resp.Body.Close()
+			cancel()
+			return nil, errTooLarge{s.maxImageSize}
+		}
+		return s.startDownload(key, ep, pubkeys, cached, resp, cancel)
+	}
+	resp.Body.Close()
+	cancel()
+	if resp.StatusCode != http.StatusNotModified || !revalidate {
+		return nil, fmt.Errorf("unable to find container: %s", resp.Status)
+	}
+
+	log.Printf("Cached %s is still valid", ep.aci)
+	entry := *cached
+	entry.Pubkeys = pubkeys
+	if err := s.storeSignature(ep, cached, &entry); err != nil {
+		return nil, err
+	}
+	if err := s.cache.setApp(key, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// startDownload brings the image in resp into the cache in the background and
+// returns once its manifest has been read from the front of it, so that a large
+// image doesn't have to be downloaded before it can be shown.  Only the whole
+// image can be checked against its signature, which is fetched, and the app
+// recorded in the cache, once the download has finished.  cancel stops the
+// download.
+func (s *server) startDownload(key string, ep aciEndpoint, pubkeys []string, cached *cachedApp, resp *http.Response, cancel context.CancelFunc) (*cachedApp, error) {
+	pr, pw := io.Pipe()
+	dl := &download{done: make(chan struct{})}
+	go func() {
+		defer cancel()
+		id, err := s.cache.store(io.TeeReader(resp.Body, &manifestWriter{pw: pw}), s.maxImageSize)
+		resp.Body.Close()
+		pw.CloseWithError(err)
+		entry := &cachedApp{
+			URL:          ep.aci,
+			ImageID:      id,
+			Pubkeys:      pubkeys,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		}
+		if err == nil {
+			err = s.storeSignature(ep, cached, entry)
+		}
+		if err == nil {
+			err = s.cache.setApp(key, entry)
+		}
+		if err != nil {
+			log.Printf("Unable to download %s: %v", ep.aci, err)
+		}
+		s.cache.finishDownload(ep.aci, dl, entry, err)
+	}()
+
+	manifest, err := readManifest(pr)
+	pr.Close()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	s.cache.startedDownload(ep.aci, dl, manifest)
+	return &cachedApp{URL: ep.aci, Pubkeys: pubkeys, download: dl}, nil
+}
+
+// storeSignature brings the signature at ep into the cache for entry.  If it
+// can't be fetched and entry is still cached's image then cached's signature is
+// kept.
+func (s *server) storeSignature(ep aciEndpoint, cached, entry *cachedApp) error {
+	asc, err := s.verifier.fetchSignature(ep.asc)
+	switch {
+	case err != nil && cached != nil && cached.URL == ep.aci && entry.ImageID == cached.ImageID:
+		log.Printf("Using cached signature for %s: %v", ep.aci, err)
+		entry.SignatureID = cached.SignatureID
+	case err != nil:
+		return err
+	case asc == nil:
+		entry.SignatureID = ""
+	default:
+		if entry.SignatureID, err = s.cache.store(bytes.NewReader(asc), int64(len(asc))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
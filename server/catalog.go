@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/appc/spec/schema"
+)
+
+// catalogTimeout is how long a configured registry has to send its catalog.
+const catalogTimeout = 10 * time.Second
+
+// catalogEntry summarizes every known version of an image, it's what the
+// frontend's image palette is built from.
+type catalogEntry struct {
+	Name          string         `json:"name"`
+	Versions      []string       `json:"versions,omitempty"`
+	Ports         []catalogPort  `json:"ports,omitempty"`
+	MountPoints   []string       `json:"mountPoints,omitempty"`
+	RequiredFlags []requiredFlag `json:"requiredFlags,omitempty"`
+
+	// Sources are where the image was found, e.g. cache or registry.
+	Sources []string `json:"sources"`
+}
+
+type catalogPort struct {
+	Name     string `json:"name"`
+	Port     uint   `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+// requiredFlag is a required-flag/* annotation, which the frontend turns into
+// an anchor that must be connected before the image can be deployed.
+type requiredFlag struct {
+	Name string `json:"name"`
+	Flag string `json:"flag"`
+	Type string `json:"type"`
+}
+
+var requiredFlagNameRe = regexp.MustCompile(`required-flag/(.*)`)
+var requiredFlagValueRe = regexp.MustCompile(`name=(.*);type=(.*)`)
+
+// catalog merges what's known about images from several sources, keyed by
+// image name.
+type catalog map[string]*catalogEntry
+
+// add records im, which was found in source.
+func (c catalog) add(im *schema.ImageManifest, source string) {
+	e := &catalogEntry{
+		Name:    im.Name.String(),
+		Sources: []string{source},
+	}
+	if version, ok := im.Labels.Get("version"); ok {
+		e.Versions = []string{version}
+	}
+	if im.App != nil {
+		for _, port := range im.App.Ports {
+			e.Ports = append(e.Ports, catalogPort{
+				Name:     port.Name.String(),
+				Port:     port.Port,
+				Protocol: port.Protocol,
+			})
+		}
+		for _, mp := range im.App.MountPoints {
+			e.MountPoints = append(e.MountPoints, mp.Name.String())
+		}
+	}
+	for _, ann := range im.Annotations {
+		name := requiredFlagNameRe.FindStringSubmatch(ann.Name.String())
+		value := requiredFlagValueRe.FindStringSubmatch(ann.Value)
+		if len(name) == 0 || len(value) == 0 {
+			continue
+		}
+		e.RequiredFlags = append(e.RequiredFlags, requiredFlag{Name: name[1], Flag: value[1], Type: value[2]})
+	}
+	c.merge(e)
+}
+
+// merge adds the versions and sources of e to the entry with the same name.
+// The ports, mount points and flags of whichever entry was seen first win.
+func (c catalog) merge(e *catalogEntry) {
+	existing, ok := c[e.Name]
+	if !ok {
+		cp := *e
+		c[e.Name] = &cp
+		return
+	}
+	existing.Versions = appendMissing(existing.Versions, e.Versions...)
+	existing.Sources = appendMissing(existing.Sources, e.Sources...)
+}
+
+// appendMissing appends each of vals to list unless it's already there.
+func appendMissing(list []string, vals ...string) []string {
+	for _, val := range vals {
+		found := false
+		for _, have := range list {
+			if have == val {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, val)
+		}
+	}
+	return list
+}
+
+// entries returns the catalog sorted by name, with each entry's versions
+// sorted.  If query is not empty only entries whose name, ports, mount points
+// or flags contain it, ignoring case, are returned.
+func (c catalog) entries(query string) []*catalogEntry {
+	var es []*catalogEntry
+	for _, e := range c {
+		if !e.matches(query) {
+			continue
+		}
+		sort.Strings(e.Versions)
+		sort.Strings(e.Sources)
+		es = append(es, e)
+	}
+	sort.Sort(catalogEntriesByName(es))
+	return es
+}
+
+func (e *catalogEntry) matches(query string) bool {
+	query = strings.ToLower(query)
+	if strings.Contains(strings.ToLower(e.Name), query) {
+		return true
+	}
+	for _, port := range e.Ports {
+		if strings.Contains(strings.ToLower(port.Name), query) {
+			return true
+		}
+	}
+	for _, mp := range e.MountPoints {
+		if strings.Contains(strings.ToLower(mp), query) {
+			return true
+		}
+	}
+	for _, rf := range e.RequiredFlags {
+		if strings.Contains(strings.ToLower(rf.Flag), query) {
+			return true
+		}
+	}
+	return false
+}
+
+type catalogEntriesByName []*catalogEntry
+
+func (es catalogEntriesByName) Len() int           { return len(es) }
+func (es catalogEntriesByName) Swap(i, j int)      { es[i], es[j] = es[j], es[i] }
+func (es catalogEntriesByName) Less(i, j int) bool { return es[i].Name < es[j].Name }
+
+// manifests returns the manifest of every cached image that was discovered as
+// an app.
+func (c *imageCache) manifests() []json.RawMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen := make(map[string]bool)
+	var ms []json.RawMessage
+	for _, app := range c.index.Apps {
+		blob, ok := c.index.Blobs[app.ImageID]
+		if !ok || blob.Manifest == nil || seen[app.ImageID] {
+			continue
+		}
+		seen[app.ImageID] = true
+		ms = append(ms, blob.Manifest)
+	}
+	return ms
+}
+
+// catalog returns what's known about every image in the registry.
+func (r *registry) catalog() catalog {
+	c := make(catalog)
+	for _, img := range r.list() {
+		c.add(img.im, "registry")
+	}
+	return c
+}
+
+// handleCatalog lists the images in the cache, the local registry and any
+// configured registries that are themselves flow servers.  The optional q
+// parameter filters the list.
+func (s *server) handleCatalog(w http.ResponseWriter, r *http.Request) error {
+	c := make(catalog)
+	for _, manifest := range s.cache.manifests() {
+		var im schema.ImageManifest
+		if err := json.Unmarshal(manifest, &im); err != nil {
+			continue
+		}
+		c.add(&im, "cache")
+	}
+	if s.registry != nil {
+		if err := s.registry.refresh(); err != nil {
+			return err
+		}
+		for _, e := range s.registry.catalog() {
+			c.merge(e)
+		}
+	}
+	for _, base := range s.catalogs {
+		es, err := s.fetchCatalog(r.Context(), base)
+		if err != nil {
+			log.Printf("Skipping catalog from %s: %v", base, err)
+			continue
+		}
+		for _, e := range es {
+			e.Sources = []string{base}
+			c.merge(e)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(c.entries(r.URL.Query().Get("q")))
+}
+
+// fetchCatalog gets the catalog of the flow registry at base, giving up after
+// catalogTimeout so that one slow registry doesn't hold up the palette.
+func (s *server) fetchCatalog(ctx context.Context, base string) ([]*catalogEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, catalogTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", strings.TrimSuffix(base, "/")+"/catalog", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.discovery.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	var es []*catalogEntry
+	if err := json.NewDecoder(resp.Body).Decode(&es); err != nil {
+		return nil, fmt.Errorf("unable to parse catalog: %v", err)
+	}
+	return es, nil
+}
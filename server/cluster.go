@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+)
+
+// clusterTarget is a cluster that kubectl operations can be run against.
+type clusterTarget struct {
+	Name string `json:"name"`
+
+	// Kubeconfig and Context pick the cluster, kubectl's defaults are used for
+	// whichever is empty.
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	Context    string `json:"context,omitempty"`
+
+	// Namespace is used for objects that aren't given one.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// defaultCluster is the only target when none are configured.
+var defaultCluster = &clusterTarget{Name: "default"}
+
+// loadClusters reads a json list of cluster targets.  The first target is used
+// when an operation doesn't name one.
+func loadClusters(path string) ([]*clusterTarget, error) {
+	if path == "" {
+		return []*clusterTarget{defaultCluster}, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read clusters: %v", err)
+	}
+	var clusters []*clusterTarget
+	if err := json.Unmarshal(data, &clusters); err != nil {
+		return nil, fmt.Errorf("unable to parse clusters in %s: %v", path, err)
+	}
+	if err := checkClusters(clusters); err != nil {
+		return nil, fmt.Errorf("bad clusters in %s: %v", path, err)
+	}
+	log.Printf("Loaded %d clusters from %s", len(clusters), path)
+	return clusters, nil
+}
+
+// checkClusters makes sure that there's at least one target, that every target
+// has a unique name and that their kubeconfigs exist.
+func checkClusters(clusters []*clusterTarget) error {
+	if len(clusters) == 0 {
+		return fmt.Errorf("no clusters given")
+	}
+	seen := make(map[string]bool)
+	for _, c := range clusters {
+		if !validLabel(c.Name) {
+			return fmt.Errorf("invalid cluster name %q", c.Name)
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("cluster %s is listed more than once", c.Name)
+		}
+		seen[c.Name] = true
+		if c.Namespace != "" && !validLabel(c.Namespace) {
+			return fmt.Errorf("cluster %s has invalid namespace %q", c.Name, c.Namespace)
+		}
+		if c.Kubeconfig != "" {
+			if _, err := os.Stat(c.Kubeconfig); err != nil {
+				return fmt.Errorf("cluster %s: %v", c.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// cluster returns the target called name, or the first target if name is
+// empty.
+func (s *server) cluster(name string) (*clusterTarget, error) {
+	if name == "" {
+		return s.clusters[0], nil
+	}
+	for _, c := range s.clusters {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown cluster %q", name)
+}
+
+// namespace returns the namespace used for objects that aren't given one.
+func (c *clusterTarget) namespace() string {
+	if c.Namespace == "" {
+		return "default"
+	}
+	return c.Namespace
+}
+
+// args returns the kubectl flags that select c.
+func (c *clusterTarget) args() []string {
+	var args []string
+	if c.Kubeconfig != "" {
+		args = append(args, "--kubeconfig="+c.Kubeconfig)
+	}
+	if c.Context != "" {
+		args = append(args, "--context="+c.Context)
+	}
+	return args
+}
+
+// handleClusters lists the clusters that user may use.  Kubeconfig paths stay
+// on the server.
+func (s *server) handleClusters(w http.ResponseWriter, r *http.Request, user string) error {
+	type clusterInfo struct {
+		Name      string `json:"name"`
+		Context   string `json:"context,omitempty"`
+		Namespace string `json:"namespace"`
+	}
+	clusters := []clusterInfo{}
+	for _, c := range s.clusters {
+		if !s.perms.allowsCluster(user, c.Name) {
+			continue
+		}
+		clusters = append(clusters, clusterInfo{Name: c.Name, Context: c.Context, Namespace: c.namespace()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(clusters)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// config is everything the server can be configured with.  It's read from a
+// json file, and every setting that has a flag can be overridden by that flag
+// or by the environment variable FLOW_<FLAG>, e.g. FLOW_TLS_CERT for
+// --tls-cert.  Flags take precedence over the environment, which takes
+// precedence over the file.
+type config struct {
+	// Listen is the address to serve on.
+	Listen string `json:"listen"`
+
+	// Kubectl is the kubectl binary, looked up in $PATH if it isn't a path.
+	Kubectl string `json:"kubectl"`
+
+	// StaticDir holds the UI, which is served under /_html/.  The UI built into
+	// the binary is used if this is empty.
+	StaticDir string `json:"staticDir"`
+
+	// StorageDir is where the server keeps its state.  The image cache lives
+	// in it unless Discovery.CacheDir says otherwise.
+	StorageDir string `json:"storageDir"`
+
+	TLS struct {
+		Cert string `json:"cert"`
+		Key  string `json:"key"`
+	} `json:"tls"`
+
+	// Clusters are the targets that kubectl operations can be run against,
+	// ClustersFile is a json file of more of them.  The first target is the
+	// default, and a target that uses kubectl's defaults is used if there are
+	// none.
+	Clusters     []*clusterTarget `json:"clusters"`
+	ClustersFile string           `json:"clustersFile"`
+
+	Discovery struct {
+		Insecure            bool       `json:"insecure"`
+		TrustedKeys         string     `json:"trustedKeys"`
+		TrustDiscoveredKeys bool       `json:"trustDiscoveredKeys"`
+		RequireSignatures   bool       `json:"requireSignatures"`
+		CacheDir            string     `json:"cacheDir"`
+		CacheSize           int64      `json:"cacheSize"`
+		MaxImageSize        int64      `json:"maxImageSize"`
+		RegistryDir         string     `json:"registryDir"`
+		Registries          stringList `json:"registries"`
+		OCIDir              string     `json:"ociDir"`
+	} `json:"discovery"`
+
+	Auth struct {
+		Mode           string     `json:"mode"`
+		Tokens         string     `json:"tokens"`
+		Htpasswd       string     `json:"htpasswd"`
+		Header         string     `json:"header"`
+		TrustedProxies stringList `json:"trustedProxies"`
+		Permissions    string     `json:"permissions"`
+		AllowedOrigins stringList `json:"allowedOrigins"`
+
+		// AllowUnauthenticated must be set for mode none to listen anywhere
+		// but on a loopback address, since anyone who can reach the server
+		// can then use every cluster.
+		AllowUnauthenticated bool `json:"allowUnauthenticated"`
+	} `json:"auth"`
+}
+
+// stringList is a list flag given as comma separated values.
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(value string) error {
+	*sl = nil
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*sl = append(*sl, v)
+		}
+	}
+	return nil
+}
+
+// flags binds the settings of c to flags in fs, with c's current values as
+// their defaults.
+func (c *config) flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "Address to serve on.")
+	fs.StringVar(&c.Kubectl, "kubectl", c.Kubectl, "Path to kubectl binary, or its name in $PATH.")
+	fs.StringVar(&c.StaticDir, "static-dir", c.StaticDir, "Directory to serve the UI's files from instead of the ones built into the binary.")
+	fs.StringVar(&c.StorageDir, "storage-dir", c.StorageDir, "Directory the server keeps its state in.")
+	fs.StringVar(&c.TLS.Cert, "tls-cert", c.TLS.Cert, "TLS certificate file, the server only speaks https if this and --tls-key are set.")
+	fs.StringVar(&c.TLS.Key, "tls-key", c.TLS.Key, "TLS private key file.")
+	fs.StringVar(&c.ClustersFile, "clusters", c.ClustersFile, "JSON list of cluster targets, each a name, kubeconfig, context and default namespace.")
+	fs.BoolVar(&c.Discovery.Insecure, "insecure-discovery", c.Discovery.Insecure, "Fall back to plain http for image discovery if https fails.")
+	fs.StringVar(&c.Discovery.TrustedKeys, "trusted-keys", c.Discovery.TrustedKeys, "Directory of gpg keys trusted to sign images.")
+	fs.BoolVar(&c.Discovery.TrustDiscoveredKeys, "trust-discovered-keys", c.Discovery.TrustDiscoveredKeys, "Trust keys found via ac-discovery-pubkeys when verifying images.")
+	fs.BoolVar(&c.Discovery.RequireSignatures, "require-signatures", c.Discovery.RequireSignatures, "Refuse images whose signatures can't be verified.")
+	fs.StringVar(&c.Discovery.CacheDir, "cache-dir", c.Discovery.CacheDir, "Directory to cache images in, defaults to cache in --storage-dir.")
+	fs.Int64Var(&c.Discovery.CacheSize, "cache-size", c.Discovery.CacheSize, "Maximum size of the image cache in bytes.")
+	fs.Int64Var(&c.Discovery.MaxImageSize, "max-image-size", c.Discovery.MaxImageSize, "Maximum size of an image download in bytes.")
+	fs.StringVar(&c.Discovery.RegistryDir, "registry-dir", c.Discovery.RegistryDir, "Directory of .aci files to serve as a discovery endpoint under /registry/.")
+	fs.Var(&c.Discovery.Registries, "registries", "Comma separated base urls of registries to try before an image's own domain.")
+	fs.StringVar(&c.Discovery.OCIDir, "oci-dir", c.Discovery.OCIDir, "Directory of OCI image layouts served as /container/oci/<layout>[:<tag>].")
+	fs.StringVar(&c.Auth.Mode, "auth", c.Auth.Mode, "How users are authenticated: none, token, htpasswd or proxy.")
+	fs.StringVar(&c.Auth.Tokens, "auth-tokens", c.Auth.Tokens, "File of \"<token> <user>\" lines for --auth=token.")
+	fs.StringVar(&c.Auth.Htpasswd, "htpasswd", c.Auth.Htpasswd, "htpasswd file, with bcrypt or SHA hashes, for --auth=htpasswd.")
+	fs.StringVar(&c.Auth.Header, "auth-header", c.Auth.Header, "Header holding the user for --auth=proxy.")
+	fs.Var(&c.Auth.TrustedProxies, "trusted-proxies", "Comma separated CIDRs that --auth=proxy accepts the user header from.")
+	fs.StringVar(&c.Auth.Permissions, "permissions", c.Auth.Permissions, "JSON file of the clusters, namespaces and kubectl operations each user is allowed.")
+	fs.Var(&c.Auth.AllowedOrigins, "allowed-origins", "Comma separated origins allowed to make cross-origin requests.")
+	fs.BoolVar(&c.Auth.AllowUnauthenticated, "allow-unauthenticated", c.Auth.AllowUnauthenticated, "Allow --auth=none when listening on an address other than loopback.")
+}
+
+// defaultConfig returns the configuration used when nothing is overridden.
+func defaultConfig() *config {
+	c := &config{
+		Listen:     "127.0.0.1:9090",
+		Kubectl:    "kubectl",
+		StorageDir: filepath.Join(os.TempDir(), "flow"),
+	}
+	c.Discovery.CacheSize = 2 << 30
+	c.Discovery.MaxImageSize = 1 << 30
+	c.Auth.Mode = "none"
+	c.Auth.Header = "X-Forwarded-User"
+	c.Auth.TrustedProxies = stringList{"127.0.0.1/32", "::1/128"}
+	return c
+}
+
+// loadConfig builds the configuration from the defaults, the file given by
+// --config or $FLOW_CONFIG, the environment and args, in that order.
+func loadConfig(args []string) (*config, error) {
+	c := defaultConfig()
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ExitOnError)
+	path := fs.String("config", os.Getenv("FLOW_CONFIG"), "JSON config file, see config in config.go.")
+	c.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		data, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read config: %v", err)
+		}
+		c = defaultConfig()
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return nil, fmt.Errorf("unable to parse config in %s: %v", *path, err)
+		}
+		fs = flag.NewFlagSet(fs.Name(), flag.ExitOnError)
+		fs.String("config", *path, "")
+		c.flags(fs)
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		env := "FLOW_" + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if v, ok := os.LookupEnv(env); ok && err == nil && f.Name != "config" {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("invalid %s: %v", env, e)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if c.Discovery.CacheDir == "" {
+		c.Discovery.CacheDir = filepath.Join(c.StorageDir, "cache")
+	}
+	return c, nil
+}
+
+// validate checks everything that can be checked before the server starts,
+// and reports every problem it finds.
+func (c *config) validate() error {
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	mustExist := func(what, path string, dir bool) {
+		if path == "" {
+			return
+		}
+		fi, err := os.Stat(path)
+		switch {
+		case err != nil:
+			fail("%s: %v", what, err)
+		case dir && !fi.IsDir():
+			fail("%s: %s is not a directory", what, path)
+		case !dir && fi.IsDir():
+			fail("%s: %s is a directory", what, path)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		fail("listen address %q: %v", c.Listen, err)
+	} else if c.Auth.Mode == "none" && !c.Auth.AllowUnauthenticated && !loopbackHost(host) {
+		fail("listening on %q without authentication lets anyone who can reach it use the clusters, pick an auth mode, listen on a loopback address or set --allow-unauthenticated", c.Listen)
+	}
+	if c.Kubectl == "" {
+		fail("no kubectl binary given")
+	} else if path, err := exec.LookPath(c.Kubectl); err != nil {
+		fail("kubectl: %v", err)
+	} else {
+		c.Kubectl = path
+	}
+	mustExist("static dir", c.StaticDir, true)
+	if c.StorageDir == "" {
+		fail("no storage dir given")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		fail("both a TLS certificate and key are needed, or neither")
+	}
+	mustExist("TLS certificate", c.TLS.Cert, false)
+	mustExist("TLS key", c.TLS.Key, false)
+
+	if len(c.Clusters) > 0 && c.ClustersFile != "" {
+		fail("clusters may be listed in the config or in a clusters file, not both")
+	} else if len(c.Clusters) > 0 {
+		if err := checkClusters(c.Clusters); err != nil {
+			fail("clusters: %v", err)
+		}
+	}
+	mustExist("clusters file", c.ClustersFile, false)
+
+	mustExist("trusted keys", c.Discovery.TrustedKeys, true)
+	mustExist("registry dir", c.Discovery.RegistryDir, true)
+	mustExist("OCI dir", c.Discovery.OCIDir, true)
+	if c.Discovery.CacheSize <= 0 {
+		fail("cache size must be positive, not %d", c.Discovery.CacheSize)
+	}
+	if c.Discovery.MaxImageSize <= 0 {
+		fail("max image size must be positive, not %d", c.Discovery.MaxImageSize)
+	}
+	for _, base := range c.Discovery.Registries {
+		if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+			fail("registry %q must be an http or https url", base)
+		}
+	}
+
+	switch c.Auth.Mode {
+	case "none", "proxy":
+	case "token":
+		if c.Auth.Tokens == "" {
+			fail("token authentication needs a tokens file")
+		}
+	case "htpasswd":
+		if c.Auth.Htpasswd == "" {
+			fail("htpasswd authentication needs an htpasswd file")
+		}
+	default:
+		fail("unknown authentication mode %q, must be one of none, token, htpasswd or proxy", c.Auth.Mode)
+	}
+	mustExist("tokens file", c.Auth.Tokens, false)
+	mustExist("htpasswd file", c.Auth.Htpasswd, false)
+	mustExist("permissions file", c.Auth.Permissions, false)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("bad configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// loopbackHost returns true if host, from a listen address, only accepts
+// connections from the machine the server is running on.
+func loopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
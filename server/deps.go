@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/appc/spec/schema"
+)
+
+// maxDependencyDepth bounds how deep a dependency tree will be followed.
+const maxDependencyDepth = 32
+
+// layerInfo describes one image in the dependency tree of a container.
+type layerInfo struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	ImageID   string            `json:"imageID,omitempty"`
+	Parent    string            `json:"parent,omitempty"`
+	Depth     int               `json:"depth"`
+	Signature *signatureInfo    `json:"signature,omitempty"`
+
+	// If the layer couldn't be resolved, Error says why.
+	Error string `json:"error,omitempty"`
+}
+
+// loadImage fetches, verifies and parses the image for app.  The image may still
+// be downloading when it returns, in which case its signature is pending and it
+// has no ImageID yet, unless whole is set or signatures are required.
+func (s *server) loadImage(app discoveryApp, whole bool) (*cachedApp, *signatureInfo, []byte, *schema.ImageManifest, error) {
+	entry, err := s.fetchApp(app)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if (whole || s.requireSignatures) && entry.download != nil {
+		if _, err := entry.download.wait(); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+	if entry, err = entry.settled(); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	sig, err := s.verifyApp(entry)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if sig.Status != signatureVerified {
+		if s.requireSignatures {
+			return nil, nil, nil, nil, fmt.Errorf("refusing %s image %s: %s", sig.Status, app, sig.Message)
+		}
+		log.Printf("WARNING: %s image %s: %s", sig.Status, app, sig.Message)
+	}
+	manifest := entry.manifest()
+	if manifest == nil {
+		if manifest, err = s.cache.manifest(entry.ImageID); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+	var im schema.ImageManifest
+	if err := json.Unmarshal(manifest, &im); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("unable to parse manifest: %v", err)
+	}
+	return entry, sig, manifest, &im, nil
+}
+
+// resolveDependencies walks the dependency tree of im, which was discovered as
+// app, and returns every image in it in depth first order.  Dependencies that
+// are missing, don't match their labels, or form a cycle are reported in the
+// Error of their layer rather than failing the whole tree.
+func (s *server) resolveDependencies(app discoveryApp, im *schema.ImageManifest) []layerInfo {
+	var layers []layerInfo
+	stack := map[string]bool{im.Name.String(): true}
+	seen := make(map[string]bool)
+	s.resolveLayer(app, im, 1, stack, seen, &layers)
+	return layers
+}
+
+func (s *server) resolveLayer(parent discoveryApp, im *schema.ImageManifest, depth int, stack, seen map[string]bool, layers *[]layerInfo) {
+	for _, dep := range im.Dependencies {
+		app := discoveryApp{
+			name: dep.ImageName.String(),
+			labels: map[string]string{
+				"os":   parent.labels["os"],
+				"arch": parent.labels["arch"],
+			},
+		}
+		for _, l := range dep.Labels {
+			app.labels[l.Name.String()] = l.Value
+		}
+		if app.labels["version"] == "" {
+			app.labels["version"] = "latest"
+		}
+		layer := layerInfo{
+			Name:   app.name,
+			Labels: app.labels,
+			Parent: im.Name.String(),
+			Depth:  depth,
+		}
+
+		switch {
+		case stack[app.name]:
+			layer.Error = fmt.Sprintf("dependency cycle: %s depends on %s", im.Name, app.name)
+			*layers = append(*layers, layer)
+			continue
+
+		case seen[app.String()]:
+			continue
+
+		case depth > maxDependencyDepth:
+			layer.Error = fmt.Sprintf("dependencies are nested more than %d deep", maxDependencyDepth)
+			*layers = append(*layers, layer)
+			continue
+		}
+		seen[app.String()] = true
+
+		// A dependency that's pinned to an image ID can only be checked
+		// once all of it has been downloaded.
+		entry, sig, _, depIM, err := s.loadImage(app, dep.ImageID != nil)
+		if err != nil {
+			layer.Error = fmt.Sprintf("unable to find dependency: %v", err)
+			*layers = append(*layers, layer)
+			continue
+		}
+		layer.ImageID = entry.ImageID
+		layer.Signature = sig
+		if dep.ImageID != nil && !strings.HasPrefix(entry.ImageID, dep.ImageID.String()) {
+			layer.Error = fmt.Sprintf("found image %s but %s requires %s", entry.ImageID, im.Name, dep.ImageID)
+		} else if err := matchLabels(app, depIM); err != nil {
+			layer.Error = err.Error()
+		}
+		*layers = append(*layers, layer)
+		if layer.Error != "" {
+			continue
+		}
+
+		stack[app.name] = true
+		s.resolveLayer(app, depIM, depth+1, stack, seen, layers)
+		delete(stack, app.name)
+	}
+}
+
+// matchLabels checks that im is the image that was asked for by app.
+func matchLabels(app discoveryApp, im *schema.ImageManifest) error {
+	if im.Name.String() != app.name {
+		return fmt.Errorf("discovered %s when looking for %s", im.Name, app.name)
+	}
+	for k, want := range app.labels {
+		if k == "version" && want == "latest" {
+			continue
+		}
+		got, ok := im.Labels.Get(k)
+		if !ok {
+			// A dependency that doesn't declare its os or arch runs anywhere.
+			if k == "os" || k == "arch" {
+				continue
+			}
+			return fmt.Errorf("%s has no %s label, wanted %s", app.name, k, want)
+		}
+		if got != want {
+			return fmt.Errorf("%s has %s=%s, wanted %s", app.name, k, got, want)
+		}
+	}
+	return nil
+}
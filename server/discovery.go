@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// discoveryApp is an image name along with the labels used to fill in the
+// discovery templates, e.g. version, os and arch.
+type discoveryApp struct {
+	name   string
+	labels map[string]string
+}
+
+func (app discoveryApp) String() string {
+	var keys []string
+	for k := range app.labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	str := app.name
+	for _, k := range keys {
+		str += fmt.Sprintf(",%s=%s", k, app.labels[k])
+	}
+	return str
+}
+
+// aciEndpoint is where an image and its detached signature can be downloaded.
+type aciEndpoint struct {
+	aci string
+	asc string
+}
+
+// discoveryResult is everything meta discovery found for an app.
+type discoveryResult struct {
+	acis    []aciEndpoint
+	pubkeys []string
+}
+
+// acMeta is a single ac-discovery or ac-discovery-pubkeys meta tag.
+type acMeta struct {
+	name   string
+	prefix string
+	uri    string
+}
+
+// discoverer implements appc meta discovery as described in
+// https://github.com/appc/spec/blob/master/spec/discovery.md.
+type discoverer struct {
+	client *http.Client
+
+	// If insecure is set then discovery falls back to plain http if https
+	// fails.  This should only be used for testing.
+	insecure bool
+
+	// registries are base urls, like http://localhost:9090/registry, that are
+	// asked for discovery documents before the domain in the image's name.
+	registries []string
+}
+
+// sources returns the bases that discoverFrom is tried against, in order: each
+// registry and then, as the empty base, the domain in the app's name.
+func (d *discoverer) sources() []string {
+	return append(append([]string(nil), d.registries...), "")
+}
+
+// discover finds the image endpoints and public keys for app from the first
+// source that has templates for it.
+func (d *discoverer) discover(app discoveryApp) (*discoveryResult, error) {
+	var errs []string
+	for _, base := range d.sources() {
+		res, err := d.discoverFrom(base, app)
+		if err == nil {
+			return res, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// discoverFrom does discovery for app against the registry at base, or against
+// the domain in the app's name if base is empty.  Discovery starts at the full
+// name of the app and walks up its path until templates that match the app
+// have been found.
+func (d *discoverer) discoverFrom(base string, app discoveryApp) (*discoveryResult, error) {
+	var res discoveryResult
+	var errs []string
+	for name := app.name; name != ""; name = parentName(name) {
+		metas, err := d.fetchMeta(base, name)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if len(res.acis) == 0 {
+			res.acis = matchACIs(metas, app)
+		}
+		if len(res.pubkeys) == 0 {
+			res.pubkeys = matchPubkeys(metas, app)
+		}
+		if len(res.acis) > 0 && len(res.pubkeys) > 0 {
+			break
+		}
+	}
+	if len(res.acis) == 0 {
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("no ac-discovery templates found for %s: %s", app, strings.Join(errs, "; "))
+		}
+		return nil, fmt.Errorf("no ac-discovery templates found for %s", app)
+	}
+	return &res, nil
+}
+
+// parentName strips the last path component off of name, returning the empty
+// string once there's nothing left above the domain.
+func parentName(name string) string {
+	slash := strings.LastIndex(name, "/")
+	if slash == -1 {
+		return ""
+	}
+	return name[0:slash]
+}
+
+// fetchMeta fetches the discovery document for name, from the registry at base
+// if one is given, and returns the discovery meta tags it contains.
+func (d *discoverer) fetchMeta(base, name string) ([]acMeta, error) {
+	var urls []string
+	if base != "" {
+		urls = append(urls, fmt.Sprintf("%s/%s?ac-discovery=1", strings.TrimSuffix(base, "/"), name))
+	} else {
+		urls = append(urls, fmt.Sprintf("https://%s?ac-discovery=1", name))
+		if d.insecure {
+			urls = append(urls, fmt.Sprintf("http://%s?ac-discovery=1", name))
+		}
+	}
+	var errs []string
+	for _, u := range urls {
+		resp, err := d.client.Get(u)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			errs = append(errs, fmt.Sprintf("%s: %s", u, resp.Status))
+			continue
+		}
+		metas, err := extractACMeta(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", u, err))
+			continue
+		}
+		log.Printf("Found %d discovery meta tags at %s", len(metas), u)
+		return metas, nil
+	}
+	return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// extractACMeta pulls every ac-discovery and ac-discovery-pubkeys meta tag out
+// of an html document.  Anything that isn't a well formed discovery tag is
+// ignored, as is anything that html.Tokenizer can't make sense of.
+func extractACMeta(r io.Reader) ([]acMeta, error) {
+	var metas []acMeta
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return metas, nil
+			}
+			return metas, z.Err()
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if tok.Data != "meta" {
+				continue
+			}
+			var name, content string
+			for _, attr := range tok.Attr {
+				switch attr.Key {
+				case "name":
+					name = attr.Val
+				case "content":
+					content = attr.Val
+				}
+			}
+			if name != "ac-discovery" && name != "ac-discovery-pubkeys" {
+				continue
+			}
+			fields := strings.Fields(content)
+			if len(fields) != 2 {
+				continue
+			}
+			metas = append(metas, acMeta{name: name, prefix: fields[0], uri: fields[1]})
+		}
+	}
+}
+
+func matchACIs(metas []acMeta, app discoveryApp) []aciEndpoint {
+	var eps []aciEndpoint
+	for _, m := range metas {
+		if m.name != "ac-discovery" || !strings.HasPrefix(app.name, m.prefix) {
+			continue
+		}
+		aci, ok := renderTemplate(m.uri, app, "aci")
+		if !ok {
+			continue
+		}
+		asc, ok := renderTemplate(m.uri, app, "aci.asc")
+		if !ok {
+			continue
+		}
+		eps = append(eps, aciEndpoint{aci: aci, asc: asc})
+	}
+	return eps
+}
+
+func matchPubkeys(metas []acMeta, app discoveryApp) []string {
+	var keys []string
+	for _, m := range metas {
+		if m.name != "ac-discovery-pubkeys" || !strings.HasPrefix(app.name, m.prefix) {
+			continue
+		}
+		if _, err := url.Parse(m.uri); err != nil {
+			continue
+		}
+		keys = append(keys, m.uri)
+	}
+	return keys
+}
+
+// renderTemplate fills in {name}, {ext} and any labels in tmpl.  It fails if
+// any placeholders are left over, since that means the template needs a label
+// that the app doesn't have.
+func renderTemplate(tmpl string, app discoveryApp, ext string) (string, bool) {
+	tmpl = strings.Replace(tmpl, "{name}", app.name, -1)
+	tmpl = strings.Replace(tmpl, "{ext}", ext, -1)
+	for k, v := range app.labels {
+		tmpl = strings.Replace(tmpl, fmt.Sprintf("{%s}", k), v, -1)
+	}
+	if strings.ContainsAny(tmpl, "{}") {
+		return "", false
+	}
+	return tmpl, true
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// discoveryServer serves a discovery document, made of metas, at each of its
+// paths, and records every path that was asked for.
+type discoveryServer struct {
+	mu        sync.Mutex
+	documents map[string]string
+	requested []string
+}
+
+func (ds *discoveryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if r.URL.Query().Get("ac-discovery") != "1" {
+		http.Error(w, "not a discovery request", http.StatusBadRequest)
+		return
+	}
+	ds.requested = append(ds.requested, r.URL.Path)
+	doc, ok := ds.documents[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprint(w, doc)
+}
+
+func metaTag(name, prefix, uri string) string {
+	return fmt.Sprintf(`<meta name="%s" content="%s %s">`, name, prefix, uri)
+}
+
+func TestDiscoverWalksUpParentNames(t *testing.T) {
+	ds := &discoveryServer{}
+	ts := httptest.NewTLSServer(ds)
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "https://")
+	ds.documents = map[string]string{
+		"/example/app": metaTag("ac-discovery", host+"/example", "https://images.example.com/{name}.{ext}"),
+		"/example":     metaTag("ac-discovery-pubkeys", host+"/example", "https://keys.example.com/pubkeys.gpg"),
+	}
+
+	d := &discoverer{client: ts.Client()}
+	app := discoveryApp{name: host + "/example/app/server"}
+	res, err := d.discover(app)
+	if err != nil {
+		t.Fatalf("discover(%s): %v", app, err)
+	}
+	wantACIs := []aciEndpoint{{
+		aci: "https://images.example.com/" + app.name + ".aci",
+		asc: "https://images.example.com/" + app.name + ".aci.asc",
+	}}
+	if !reflect.DeepEqual(res.acis, wantACIs) {
+		t.Errorf("acis = %+v, want %+v", res.acis, wantACIs)
+	}
+	if want := []string{"https://keys.example.com/pubkeys.gpg"}; !reflect.DeepEqual(res.pubkeys, want) {
+		t.Errorf("pubkeys = %q, want %q", res.pubkeys, want)
+	}
+	wantPaths := []string{"/example/app/server", "/example/app", "/example"}
+	if !reflect.DeepEqual(ds.requested, wantPaths) {
+		t.Errorf("requested %q, want %q", ds.requested, wantPaths)
+	}
+}
+
+func TestDiscoverFromRegistry(t *testing.T) {
+	ds := &discoveryServer{documents: map[string]string{
+		"/registry/example.com/app": metaTag("ac-discovery", "example.com/app", "http://registry.local/{name}-{version}.{ext}"),
+	}}
+	ts := httptest.NewServer(ds)
+	defer ts.Close()
+
+	d := &discoverer{client: ts.Client(), registries: []string{ts.URL + "/registry/"}}
+	app := discoveryApp{name: "example.com/app", labels: map[string]string{"version": "1.0"}}
+	res, err := d.discover(app)
+	if err != nil {
+		t.Fatalf("discover(%s): %v", app, err)
+	}
+	if len(res.acis) != 1 || res.acis[0].aci != "http://registry.local/example.com/app-1.0.aci" {
+		t.Errorf("acis = %+v, want the registry's", res.acis)
+	}
+}
+
+func TestDiscoverInsecureFallback(t *testing.T) {
+	ds := &discoveryServer{}
+	ts := httptest.NewServer(ds)
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+	ds.documents = map[string]string{
+		"/app": metaTag("ac-discovery", host+"/app", "http://"+host+"/{name}.{ext}"),
+	}
+	app := discoveryApp{name: host + "/app"}
+
+	d := &discoverer{client: ts.Client()}
+	if _, err := d.discover(app); err == nil {
+		t.Errorf("discover(%s) succeeded over http without insecure set", app)
+	}
+	d.insecure = true
+	res, err := d.discover(app)
+	if err != nil {
+		t.Fatalf("discover(%s) with insecure set: %v", app, err)
+	}
+	if len(res.acis) != 1 {
+		t.Errorf("acis = %+v, want one", res.acis)
+	}
+}
+
+func TestExtractACMeta(t *testing.T) {
+	doc := `<!DOCTYPE html>
+<HTML><head>
+<p><b>unclosed <img src=x alt=unquoted>
+<META NAME="ac-discovery" CONTENT="example.com https://example.com/{name}.{ext}" />
+<meta name="ac-discovery" content="too many fields here">
+<meta name="ac-discovery" content="">
+<meta name="description" content="example.com not-discovery">
+<meta content="example.com https://example.com/pubkeys.gpg" name="ac-discovery-pubkeys">
+</head>
+<body><p>stray </div> tags <meta name="ac-discovery" content="example.com/other   https://other.example.com/{name}.{ext}"></body>`
+	metas, err := extractACMeta(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("extractACMeta: %v", err)
+	}
+	want := []acMeta{
+		{name: "ac-discovery", prefix: "example.com", uri: "https://example.com/{name}.{ext}"},
+		{name: "ac-discovery-pubkeys", prefix: "example.com", uri: "https://example.com/pubkeys.gpg"},
+		{name: "ac-discovery", prefix: "example.com/other", uri: "https://other.example.com/{name}.{ext}"},
+	}
+	if !reflect.DeepEqual(metas, want) {
+		t.Errorf("extractACMeta = %+v, want %+v", metas, want)
+	}
+}
+
+func TestMatchACIsSubstitutesLabels(t *testing.T) {
+	metas := []acMeta{
+		{name: "ac-discovery", prefix: "example.com/app", uri: "https://example.com/{name}-{version}-{os}-{arch}.{ext}"},
+		{name: "ac-discovery", prefix: "example.com/app", uri: "https://example.com/{name}-{missing}.{ext}"},
+		{name: "ac-discovery", prefix: "example.com/other", uri: "https://example.com/{name}.{ext}"},
+	}
+	app := discoveryApp{name: "example.com/app", labels: map[string]string{"version": "1.2", "os": "linux", "arch": "amd64"}}
+	want := []aciEndpoint{{
+		aci: "https://example.com/example.com/app-1.2-linux-amd64.aci",
+		asc: "https://example.com/example.com/app-1.2-linux-amd64.aci.asc",
+	}}
+	if eps := matchACIs(metas, app); !reflect.DeepEqual(eps, want) {
+		t.Errorf("matchACIs = %+v, want %+v", eps, want)
+	}
+}
+
+func TestMatchPubkeys(t *testing.T) {
+	metas := []acMeta{
+		{name: "ac-discovery-pubkeys", prefix: "example.com", uri: "https://example.com/pubkeys.gpg"},
+		{name: "ac-discovery-pubkeys", prefix: "other.com", uri: "https://other.com/pubkeys.gpg"},
+		{name: "ac-discovery-pubkeys", prefix: "example.com", uri: "%zz"},
+		{name: "ac-discovery", prefix: "example.com", uri: "https://example.com/{name}.{ext}"},
+	}
+	want := []string{"https://example.com/pubkeys.gpg"}
+	if keys := matchPubkeys(metas, discoveryApp{name: "example.com/app"}); !reflect.DeepEqual(keys, want) {
+		t.Errorf("matchPubkeys = %q, want %q", keys, want)
+	}
+}
+
+func TestParentName(t *testing.T) {
+	for name, want := range map[string]string{
+		"example.com/a/b": "example.com/a",
+		"example.com/a":   "example.com",
+		"example.com":     "",
+	} {
+		if got := parentName(name); got != want {
+			t.Errorf("parentName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
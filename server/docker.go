@@ -0,0 +1,627 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+// Media types of the manifests and indexes that can be read.  Docker and OCI
+// images are laid out the same way, so both are handled by the same code.
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+// ociRefName is the annotation that names a manifest in an OCI layout's index.
+const ociRefName = "org.opencontainers.image.ref.name"
+
+// dockerArch maps appc arch labels to the names used by docker where they
+// differ, and appcArch maps them back.
+var dockerArch = map[string]string{
+	"aarch64": "arm64",
+	"armv7l":  "arm",
+	"i386":    "386",
+}
+var appcArch = map[string]string{
+	"arm64": "aarch64",
+	"arm":   "armv7l",
+	"386":   "i386",
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+// ociManifest is either an image manifest or an index of them, depending on
+// its media type.
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Config    ociDescriptor   `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// dockerConfig is the part of an image's config that flow cares about.
+type dockerConfig struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Config       struct {
+		User         string              `json:"User"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+		Volumes      map[string]struct{} `json:"Volumes"`
+		Env          []string            `json:"Env"`
+		Entrypoint   []string            `json:"Entrypoint"`
+		Cmd          []string            `json:"Cmd"`
+		WorkingDir   string              `json:"WorkingDir"`
+		Labels       map[string]string   `json:"Labels"`
+	} `json:"config"`
+}
+
+// ociStore is somewhere that manifests and blobs can be read from, either a
+// registry or an OCI layout on disk.
+type ociStore interface {
+	manifest(ref string) (*ociManifest, error)
+	blob(digest string) ([]byte, error)
+}
+
+// dockerRef is a parsed docker image reference such as
+// gcr.io/project/image:tag or nginx@sha256:<hex>.
+type dockerRef struct {
+	domain string
+	repo   string
+	tag    string
+	digest string
+}
+
+// parseDockerRef parses ref the way the docker cli does, so nginx is
+// docker.io/library/nginx:latest.
+func parseDockerRef(ref string) (*dockerRef, error) {
+	var r dockerRef
+	if at := strings.Index(ref, "@"); at != -1 {
+		r.digest = ref[at+1:]
+		ref = ref[:at]
+	}
+	if colon := strings.LastIndex(ref, ":"); colon > strings.LastIndex(ref, "/") {
+		r.tag = ref[colon+1:]
+		ref = ref[:colon]
+	}
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		r.domain = parts[0]
+		r.repo = parts[1]
+	} else {
+		r.domain = "docker.io"
+		r.repo = ref
+	}
+	if r.domain == "docker.io" && !strings.Contains(r.repo, "/") {
+		r.repo = "library/" + r.repo
+	}
+	if r.repo == "" {
+		return nil, fmt.Errorf("invalid image reference %q", ref)
+	}
+	if r.tag == "" && r.digest == "" {
+		r.tag = "latest"
+	}
+	return &r, nil
+}
+
+// String returns the fully qualified reference, which is what the cluster
+// should pull.
+func (r *dockerRef) String() string {
+	str := r.domain + "/" + r.repo
+	if r.tag != "" {
+		str += ":" + r.tag
+	}
+	if r.digest != "" {
+		str += "@" + r.digest
+	}
+	return str
+}
+
+// registryV2 reads images from a docker registry using the v2 http api.
+type registryV2 struct {
+	client   *http.Client
+	base     string
+	repo     string
+	insecure bool
+	token    string
+}
+
+func newRegistryV2(client *http.Client, domain, repo string, insecure bool) *registryV2 {
+	if domain == "docker.io" {
+		domain = "registry-1.docker.io"
+	}
+	return &registryV2{
+		client:   client,
+		base:     "https://" + domain,
+		repo:     repo,
+		insecure: insecure,
+	}
+}
+
+func (r *registryV2) manifest(ref string) (*ociManifest, error) {
+	accept := []string{mediaTypeDockerManifest, mediaTypeDockerManifestList, mediaTypeOCIManifest, mediaTypeOCIIndex}
+	data, mediaType, err := r.get(fmt.Sprintf("/v2/%s/manifests/%s", r.repo, ref), accept)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(ref, "sha256:") {
+		if err := checkDigest(data, ref); err != nil {
+			return nil, err
+		}
+	}
+	return parseOCIManifest(data, mediaType)
+}
+
+func (r *registryV2) blob(digest string) ([]byte, error) {
+	data, _, err := r.get(fmt.Sprintf("/v2/%s/blobs/%s", r.repo, digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	return data, checkDigest(data, digest)
+}
+
+// get fetches path from the registry, getting an anonymous pull token if the
+// registry asks for one.  If the registry is insecure then plain http is tried
+// if https fails.
+func (r *registryV2) get(path string, accept []string) ([]byte, string, error) {
+	data, mediaType, err := r.getFrom(r.base, path, accept)
+	if err != nil && r.insecure && strings.HasPrefix(r.base, "https://") {
+		base := "http://" + strings.TrimPrefix(r.base, "https://")
+		if data, mediaType, herr := r.getFrom(base, path, accept); herr == nil {
+			r.base = base
+			return data, mediaType, nil
+		}
+	}
+	return data, mediaType, err
+}
+
+func (r *registryV2) getFrom(base, path string, accept []string) ([]byte, string, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequest("GET", base+path, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+		if r.token != "" {
+			req.Header.Set("Authorization", "Bearer "+r.token)
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if r.token, err = r.fetchToken(challenge); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, "", fmt.Errorf("%s%s: %s", base, path, resp.Status)
+		}
+		data, err := ioutil.ReadAll(&limitedReader{r: resp.Body, limit: maxManifestSize})
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to read %s%s: %v", base, path, err)
+		}
+		return data, resp.Header.Get("Content-Type"), nil
+	}
+	return nil, "", fmt.Errorf("%s%s: not authorized", base, path)
+}
+
+var challengeParamRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// fetchToken gets an anonymous token to pull r.repo, as described by a Bearer
+// WWW-Authenticate challenge.
+func (r *registryV2) fetchToken(challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("registry requires unsupported authentication %q", challenge)
+	}
+	params := make(map[string]string)
+	for _, m := range challengeParamRe.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("registry authentication challenge has no realm: %q", challenge)
+	}
+	q := url.Values{}
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	q.Set("scope", fmt.Sprintf("repository:%s:pull", r.repo))
+	resp, err := r.client.Get(params["realm"] + "?" + q.Encode())
+	if err != nil {
+		return "", fmt.Errorf("unable to get registry token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to get registry token: %s", resp.Status)
+	}
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&tok); err != nil {
+		return "", fmt.Errorf("unable to parse registry token: %v", err)
+	}
+	if tok.Token == "" {
+		tok.Token = tok.AccessToken
+	}
+	return tok.Token, nil
+}
+
+// ociLayout reads images from an OCI image layout directory.
+type ociLayout struct {
+	dir string
+}
+
+// manifest finds the manifest tagged ref in the layout's index.
+func (l *ociLayout) manifest(ref string) (*ociManifest, error) {
+	if strings.HasPrefix(ref, "sha256:") {
+		data, err := l.blob(ref)
+		if err != nil {
+			return nil, err
+		}
+		return parseOCIManifest(data, "")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(l.dir, "index.json"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read OCI layout: %v", err)
+	}
+	index, err := parseOCIManifest(data, mediaTypeOCIIndex)
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range index.Manifests {
+		if desc.Annotations[ociRefName] == ref {
+			return l.manifest(desc.Digest)
+		}
+	}
+	if len(index.Manifests) == 1 && ref == "latest" {
+		return l.manifest(index.Manifests[0].Digest)
+	}
+	return nil, fmt.Errorf("%s has no image tagged %s", l.dir, ref)
+}
+
+func (l *ociLayout) blob(digest string) ([]byte, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || strings.ContainsAny(parts[1], "/\\.") {
+		return nil, fmt.Errorf("invalid digest %q", digest)
+	}
+	f, err := os.Open(filepath.Join(l.dir, "blobs", parts[0], parts[1]))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read blob: %v", err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(&limitedReader{r: f, limit: maxManifestSize})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read blob %s: %v", digest, err)
+	}
+	return data, checkDigest(data, digest)
+}
+
+func parseOCIManifest(data []byte, mediaType string) (*ociManifest, error) {
+	var m ociManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("unable to parse image manifest: %v", err)
+	}
+	if m.MediaType == "" {
+		m.MediaType = mediaType
+	}
+	if m.MediaType == "" && len(m.Manifests) > 0 {
+		m.MediaType = mediaTypeOCIIndex
+	}
+	return &m, nil
+}
+
+// checkDigest verifies that data has the given sha256 digest.
+func checkDigest(data []byte, digest string) error {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return fmt.Errorf("unsupported digest %q", digest)
+	}
+	sum := sha256.Sum256(data)
+	if got := "sha256:" + hex.EncodeToString(sum[:]); got != digest {
+		return fmt.Errorf("content has digest %s, expected %s", got, digest)
+	}
+	return nil
+}
+
+// resolveOCIImage finds the image tagged ref in store, picking the image for
+// the os and arch in labels if ref is a multi-platform index.
+func resolveOCIImage(store ociStore, ref string, labels map[string]string) (*ociManifest, *dockerConfig, error) {
+	m, err := store.manifest(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	arch := labels["arch"]
+	if a, ok := dockerArch[arch]; ok {
+		arch = a
+	}
+	if m.MediaType == mediaTypeOCIIndex || m.MediaType == mediaTypeDockerManifestList {
+		var digest string
+		for _, desc := range m.Manifests {
+			if desc.Platform != nil && desc.Platform.OS == labels["os"] && desc.Platform.Architecture == arch {
+				digest = desc.Digest
+				break
+			}
+		}
+		if digest == "" {
+			return nil, nil, fmt.Errorf("no image for %s/%s", labels["os"], arch)
+		}
+		if m, err = store.manifest(digest); err != nil {
+			return nil, nil, err
+		}
+	}
+	if m.Config.Digest == "" {
+		return nil, nil, fmt.Errorf("image manifest has no config")
+	}
+	data, err := store.blob(m.Config.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cfg dockerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, nil, fmt.Errorf("unable to parse image config: %v", err)
+	}
+	if (cfg.OS != "" && cfg.OS != labels["os"]) || (cfg.Architecture != "" && cfg.Architecture != arch) {
+		return nil, nil, fmt.Errorf("image is for %s/%s, not %s/%s", cfg.OS, cfg.Architecture, labels["os"], arch)
+	}
+	return m, &cfg, nil
+}
+
+var invalidACNameRe = regexp.MustCompile(`[^a-z0-9]+`)
+var invalidACIdentifierRe = regexp.MustCompile(`[^a-z0-9._~/-]+`)
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// toACName turns str into something that's valid as an appc name, e.g. the
+// name of a port or mount point.
+func toACName(str string) string {
+	return strings.Trim(invalidACNameRe.ReplaceAllString(strings.ToLower(str), "-"), "-")
+}
+
+func toACIdentifier(str string) string {
+	return strings.Trim(invalidACIdentifierRe.ReplaceAllString(strings.ToLower(str), "-"), "-._~/")
+}
+
+// normalizeDockerConfig builds the appc manifest equivalent to cfg, so that the
+// frontend can treat docker images just like ACIs.  Exposed ports, volumes,
+// the environment and the entrypoint all map across directly, labels become
+// annotations, which means labels like required-flag/<name> work the same way
+// as they do for ACIs.
+func normalizeDockerConfig(name, version string, cfg *dockerConfig) *schema.ImageManifest {
+	im := &schema.ImageManifest{
+		ACKind:    schema.ImageManifestKind,
+		ACVersion: schema.AppContainerVersion,
+		Name:      types.ACIdentifier(toACIdentifier(name)),
+		Labels: types.Labels{
+			{Name: "version", Value: version},
+		},
+		App: &types.App{
+			User:             "0",
+			Group:            "0",
+			WorkingDirectory: cfg.Config.WorkingDir,
+		},
+	}
+	if cfg.OS != "" {
+		im.Labels = append(im.Labels, types.Label{Name: "os", Value: cfg.OS})
+	}
+	if arch := cfg.Architecture; arch != "" {
+		if a, ok := appcArch[arch]; ok {
+			arch = a
+		}
+		im.Labels = append(im.Labels, types.Label{Name: "arch", Value: arch})
+	}
+
+	if user := cfg.Config.User; user != "" {
+		parts := strings.SplitN(user, ":", 2)
+		im.App.User = parts[0]
+		if len(parts) == 2 {
+			im.App.Group = parts[1]
+		}
+	}
+
+	// appc requires an absolute path to exec, docker will happily search $PATH.
+	exec := append(append([]string{}, cfg.Config.Entrypoint...), cfg.Config.Cmd...)
+	if len(exec) == 0 || !path.IsAbs(exec[0]) {
+		exec = append([]string{"/usr/bin/env"}, exec...)
+	}
+	im.App.Exec = exec
+
+	for _, env := range cfg.Config.Env {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 || !envNameRe.MatchString(parts[0]) {
+			continue
+		}
+		im.App.Environment = append(im.App.Environment, types.EnvironmentVariable{Name: parts[0], Value: parts[1]})
+	}
+
+	var ports []string
+	for port := range cfg.Config.ExposedPorts {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	for _, port := range ports {
+		var num uint
+		proto := "tcp"
+		if slash := strings.Index(port, "/"); slash != -1 {
+			proto = port[slash+1:]
+			port = port[:slash]
+		}
+		if _, err := fmt.Sscanf(port, "%d", &num); err != nil {
+			continue
+		}
+		im.App.Ports = append(im.App.Ports, types.Port{
+			Name:     types.ACName(fmt.Sprintf("%s-%d", proto, num)),
+			Protocol: proto,
+			Port:     num,
+			Count:    1,
+		})
+	}
+
+	var volumes []string
+	for volume := range cfg.Config.Volumes {
+		volumes = append(volumes, volume)
+	}
+	sort.Strings(volumes)
+	for _, volume := range volumes {
+		if toACName(volume) == "" {
+			continue
+		}
+		im.App.MountPoints = append(im.App.MountPoints, types.MountPoint{
+			Name: types.ACName(toACName(volume)),
+			Path: volume,
+		})
+	}
+
+	var labels []string
+	for label := range cfg.Config.Labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		if id := toACIdentifier(label); id != "" {
+			im.Annotations = append(im.Annotations, types.Annotation{Name: types.ACIdentifier(id), Value: cfg.Config.Labels[label]})
+		}
+	}
+	return im
+}
+
+// loadOCIImage reads the image tagged ref from store and turns it into a
+// containerInfo, caching the result as key so that it's still available if the
+// store can't be reached later.
+func (s *server) loadOCIImage(store ociStore, key, name, ref, image string, labels map[string]string) (*containerInfo, error) {
+	info := &containerInfo{
+		Image: image,
+		Signature: signatureInfo{
+			Status:  signatureUnsigned,
+			Message: "signatures are only checked for ACIs",
+		},
+	}
+	if s.requireSignatures {
+		return nil, fmt.Errorf("refusing unsigned image %s: %s", image, info.Signature.Message)
+	}
+
+	m, cfg, err := resolveOCIImage(store, ref, labels)
+	if err != nil {
+		cached := s.cache.lookup(key)
+		if cached == nil {
+			return nil, err
+		}
+		log.Printf("Using cached %s: %v", key, err)
+		if info.Manifest, err = s.cache.manifest(cached.ImageID); err != nil {
+			return nil, err
+		}
+		return info, nil
+	}
+
+	version := ref
+	if strings.HasPrefix(version, "sha256:") {
+		version = "latest"
+	}
+	im := normalizeDockerConfig(name, version, cfg)
+	if info.Manifest, err = json.Marshal(im); err != nil {
+		return nil, fmt.Errorf("unable to convert image config: %v", err)
+	}
+	for _, layer := range m.Layers {
+		info.Layers = append(info.Layers, layerInfo{
+			Name:    layer.Digest,
+			ImageID: layer.Digest,
+			Parent:  im.Name.String(),
+			Depth:   1,
+		})
+	}
+
+	id, err := s.cache.storeManifest(info.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.cache.setApp(key, &cachedApp{URL: image, ImageID: id}); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// dockerContainer handles a request for /container/docker/<reference>.
+func (s *server) dockerContainer(ref string, labels map[string]string) (*containerInfo, error) {
+	r, err := parseDockerRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Fetching docker image %s", r)
+	store := newRegistryV2(s.discovery.client, r.domain, r.repo, s.discovery.insecure)
+	tag := r.digest
+	if tag == "" {
+		tag = r.tag
+	}
+	app := discoveryApp{name: "docker:" + r.String(), labels: labels}
+	return s.loadOCIImage(store, app.String(), r.domain+"/"+r.repo, tag, r.String(), labels)
+}
+
+// ociContainer handles a request for /container/oci/<layout>[:<tag>], where
+// layout is a directory under --oci-dir.
+func (s *server) ociContainer(ref string, labels map[string]string) (*containerInfo, error) {
+	if s.ociDir == "" {
+		return nil, fmt.Errorf("no OCI layout directory configured, see --oci-dir")
+	}
+	name, tag := ref, "latest"
+	if colon := strings.LastIndex(ref, ":"); colon != -1 {
+		name, tag = ref[:colon], ref[colon+1:]
+	}
+	dir := filepath.Join(s.ociDir, filepath.FromSlash(path.Clean("/"+name)))
+	log.Printf("Reading OCI layout %s", dir)
+	store := &ociLayout{dir: dir}
+	app := discoveryApp{name: "oci:" + ref, labels: labels}
+	info, err := s.loadOCIImage(store, app.String(), name, tag, name+":"+tag, labels)
+	if err != nil {
+		return nil, err
+	}
+	// The layout is only on the flow server's disk, so the cluster's nodes
+	// have nowhere to pull it from.
+	info.Image = ""
+	info.Undeployable = fmt.Sprintf("OCI layout %s is only on the flow server, push it to a registry to deploy it", name)
+	return info, nil
+}
+
+// storeManifest adds a manifest that didn't come out of an ACI to the cache.
+func (c *imageCache) storeManifest(manifest []byte) (string, error) {
+	id, err := c.store(bytes.NewReader(manifest), int64(len(manifest)))
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if blob, ok := c.index.Blobs[id]; ok {
+		blob.Manifest = manifest
+	}
+	return id, c.save()
+}
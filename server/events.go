@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flowManagedLabel marks the objects that flow created, and workspaceLabel
+// says which workspace created them.
+const (
+	flowManagedLabel = "flow-managed"
+	workspaceLabel   = "flow-workspace"
+)
+
+// flowEvent is an event about one of the objects that flow manages.
+type flowEvent struct {
+	// FlowID is the flow-id label of the object the event is about, which
+	// identifies the node in the workspace.
+	FlowID string `json:"flowID"`
+
+	// Workspace is the flow-workspace label of the object, which identifies
+	// the workspace that deployed it.
+	Workspace string `json:"workspace,omitempty"`
+
+	UID       string `json:"uid"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Reason    string `json:"reason"`
+	Message   string `json:"message"`
+	Count     int    `json:"count"`
+	FirstSeen string `json:"firstSeen"`
+	LastSeen  string `json:"lastSeen"`
+}
+
+// kubeEvent is the part of an Event that flow uses.
+type kubeEvent struct {
+	Metadata struct {
+		UID string `json:"uid"`
+	} `json:"metadata"`
+	InvolvedObject struct {
+		Kind string `json:"kind"`
+		Name string `json:"name"`
+	} `json:"involvedObject"`
+	Type           string `json:"type"`
+	Reason         string `json:"reason"`
+	Message        string `json:"message"`
+	Count          int    `json:"count"`
+	FirstTimestamp string `json:"firstTimestamp"`
+	LastTimestamp  string `json:"lastTimestamp"`
+}
+
+// eventOwners maps the kind and name of every RC and pod that flow manages in a
+// namespace, or that one workspace manages if workspace is set, to its labels.
+type eventOwners struct {
+	s         *server
+	cluster   *clusterTarget
+	namespace string
+	workspace string
+
+	mu        sync.Mutex
+	owners    map[string]map[string]string
+	refreshed time.Time
+}
+
+// ownerRefreshInterval limits how often unknown pods cause the owners to be
+// looked up again, since most namespaces have pods that flow doesn't manage.
+const ownerRefreshInterval = 5 * time.Second
+
+func (eo *eventOwners) refresh(ctx context.Context) error {
+	selector := map[string]string{flowManagedLabel: "true"}
+	if eo.workspace != "" {
+		selector[workspaceLabel] = eo.workspace
+	}
+	owners := make(map[string]map[string]string)
+	for _, kind := range []string{"ReplicationController", "Pod"} {
+		op := &kubeOp{Op: "get", Kind: kindNames[strings.ToLower(kind)], Namespace: eo.namespace, Selector: selector}
+		output, err := exec.CommandContext(ctx, eo.s.kubectl, op.args(eo.cluster, nil)...).Output()
+		if err != nil {
+			return fmt.Errorf("unable to list %s: %v", op.Kind, err)
+		}
+		var list struct {
+			Items []struct {
+				Metadata struct {
+					Name   string            `json:"name"`
+					Labels map[string]string `json:"labels"`
+				} `json:"metadata"`
+			} `json:"items"`
+		}
+		if err := json.Unmarshal(output, &list); err != nil {
+			return fmt.Errorf("unable to parse %s: %v", op.Kind, err)
+		}
+		for _, item := range list.Items {
+			if item.Metadata.Labels["flow-id"] != "" {
+				owners[kind+"/"+item.Metadata.Name] = item.Metadata.Labels
+			}
+		}
+	}
+	eo.mu.Lock()
+	eo.owners = owners
+	eo.refreshed = time.Now()
+	eo.mu.Unlock()
+	return nil
+}
+
+// event converts ev to a flowEvent, returning false if flow doesn't manage the
+// object it's about.  Pods come and go, so they're looked for again if one
+// isn't known.
+func (eo *eventOwners) event(ctx context.Context, ev *kubeEvent) (*flowEvent, bool) {
+	key := ev.InvolvedObject.Kind + "/" + ev.InvolvedObject.Name
+	eo.mu.Lock()
+	labels, ok := eo.owners[key]
+	stale := time.Since(eo.refreshed) > ownerRefreshInterval
+	eo.mu.Unlock()
+	if !ok && stale && ev.InvolvedObject.Kind == "Pod" {
+		if err := eo.refresh(ctx); err != nil {
+			log.Printf("Unable to refresh event owners: %v", err)
+		}
+		eo.mu.Lock()
+		labels, ok = eo.owners[key]
+		eo.mu.Unlock()
+	}
+	if !ok {
+		return nil, false
+	}
+	return &flowEvent{
+		FlowID:    labels["flow-id"],
+		Workspace: labels[workspaceLabel],
+		UID:       ev.Metadata.UID,
+		Kind:      ev.InvolvedObject.Kind,
+		Name:      ev.InvolvedObject.Name,
+		Type:      ev.Type,
+		Reason:    ev.Reason,
+		Message:   ev.Message,
+		Count:     ev.Count,
+		FirstSeen: ev.FirstTimestamp,
+		LastSeen:  ev.LastTimestamp,
+	}, true
+}
+
+// handleEvents lists the events about the RCs and pods that flow manages in a
+// namespace, as one json object per line.  With workspace set only the objects
+// of that workspace are considered, and with watch=true it then keeps streaming
+// new events until the client goes away.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request, user string) error {
+	q := r.URL.Query()
+	op := &kubeOp{Op: "get", Kind: "events", Cluster: q.Get("cluster"), Namespace: q.Get("namespace")}
+	watch := false
+	if v := q.Get("watch"); v != "" {
+		var err error
+		if watch, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid watch %q", v), http.StatusBadRequest)
+			return nil
+		}
+	}
+	workspace := q.Get("workspace")
+	if !selectorValueRe.MatchString(workspace) {
+		http.Error(w, fmt.Sprintf("invalid workspace %q", workspace), http.StatusBadRequest)
+		return nil
+	}
+	cluster, err := s.cluster(op.Cluster)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if _, err := op.validate(nil, cluster.namespace()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := s.perms.check(user, cluster.Name, op.Op, op.Namespace); err != nil {
+		log.Printf("Refusing events: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil
+	}
+
+	ctx := r.Context()
+	owners := &eventOwners{s: s, cluster: cluster, namespace: op.Namespace, workspace: workspace}
+	if err := owners.refresh(ctx); err != nil {
+		return err
+	}
+	output, err := exec.CommandContext(ctx, s.kubectl, op.args(cluster, nil)...).Output()
+	if err != nil {
+		return fmt.Errorf("unable to list events: %v", err)
+	}
+	var list struct {
+		Items []kubeEvent `json:"items"`
+	}
+	if err := json.Unmarshal(output, &list); err != nil {
+		return fmt.Errorf("unable to parse events: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	send := func(ev *kubeEvent) error {
+		fe, ok := owners.event(ctx, ev)
+		if !ok {
+			return nil
+		}
+		if err := enc.Encode(fe); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	for i := range list.Items {
+		if err := send(&list.Items[i]); err != nil {
+			return nil
+		}
+	}
+	if !watch {
+		return nil
+	}
+
+	op.Watch = true
+	cmd := exec.CommandContext(ctx, s.kubectl, op.args(cluster, nil)...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("Unable to watch events: %v", err)
+		return nil
+	}
+	defer cmd.Wait()
+	dec := json.NewDecoder(out)
+	for {
+		var ev kubeEvent
+		if err := dec.Decode(&ev); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Stopped watching events in %s on %s: %v", op.Namespace, cluster.Name, err)
+			}
+			return nil
+		}
+		if err := send(&ev); err != nil {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/net/websocket"
+)
+
+// The streams of an exec session, named as in the frontend's types.go.
+// Resize carries the size of the client's terminal.
+const (
+	streamStdin  = "stdin"
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+	streamError  = "error"
+	streamResize = "resize"
+)
+
+// streamMessage is what's sent either way over an exec session's websocket.
+type streamMessage struct {
+	Stream string `json:"stream"`
+	Data   string `json:"data,omitempty"`
+	Cols   int    `json:"cols,omitempty"`
+	Rows   int    `json:"rows,omitempty"`
+}
+
+// execOp makes the exec operation described by the query q.  The pod is given
+// by name or by a selector, in which case the first pod that matches is used,
+// and the command by one or more command parameters.
+func execOp(q url.Values) (*kubeOp, error) {
+	op := &kubeOp{
+		Op:        "exec",
+		Kind:      "pods",
+		Cluster:   q.Get("cluster"),
+		Name:      q.Get("name"),
+		Namespace: q.Get("namespace"),
+		Container: q.Get("container"),
+		Command:   q["command"],
+	}
+	selector, err := querySelector(q)
+	if err != nil {
+		return nil, err
+	}
+	op.Selector = selector
+	if v := q.Get("tty"); v != "" {
+		if op.TTY, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid tty %q", v)
+		}
+	}
+	return op, nil
+}
+
+// handleExec runs a command in a pod and connects it to a websocket, see
+// execOp and streamMessage.  With tty=true the command gets a terminal, which
+// the client can resize.
+func (s *server) handleExec(w http.ResponseWriter, r *http.Request, user string) error {
+	op, err := execOp(r.URL.Query())
+	if err != nil {
+		return err
+	}
+	cluster, err := s.cluster(op.Cluster)
+	if err != nil {
+		return err
+	}
+	if _, err := op.validate(nil, cluster.namespace()); err != nil {
+		return err
+	}
+	if err := s.perms.check(user, cluster.Name, op.Op, op.Namespace); err != nil {
+		log.Printf("Refusing exec: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil
+	}
+	if err := s.resolvePod(r.Context(), cluster, op); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil
+	}
+	websocket.Server{
+		Handshake: s.checkOrigin,
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			log.Printf("%s is running %q in %s/%s on %s", user, op.Command, op.Namespace, op.Name, cluster.Name)
+			if err := s.runExec(ws, cluster, op); err != nil {
+				log.Printf("Exec in %s/%s failed: %v", op.Namespace, op.Name, err)
+			}
+		},
+	}.ServeHTTP(w, r)
+	return nil
+}
+
+// resolvePod sets op.Name to the first pod that matches op.Selector if no pod
+// was named.
+func (s *server) resolvePod(ctx context.Context, cluster *clusterTarget, op *kubeOp) error {
+	if op.Name != "" {
+		op.Selector = nil
+		return nil
+	}
+	pods, err := s.podNames(ctx, cluster, op.Namespace, op.Selector)
+	if err != nil {
+		return err
+	}
+	if len(pods) == 0 {
+		return fmt.Errorf("no pods match")
+	}
+	op.Name = pods[0]
+	op.Selector = nil
+	return nil
+}
+
+// checkOrigin only lets browsers open websockets from pages we served or from
+// allowed origins, since cookies are sent with them regardless.
+func (s *server) checkOrigin(config *websocket.Config, r *http.Request) error {
+	return s.sameOrigin(r)
+}
+
+// runExec runs op and passes its input and output over ws until either ends.
+func (s *server) runExec(ws *websocket.Conn, cluster *clusterTarget, op *kubeOp) error {
+	ctx, cancel := context.WithCancel(ws.Request().Context())
+	defer cancel()
+
+	var mu sync.Mutex
+	send := func(msg streamMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		websocket.JSON.Send(ws, msg)
+	}
+
+	var stdin io.Writer
+	var tty *os.File
+	var outputs []io.Reader
+	streams := []string{streamStdout, streamStderr}
+	cmd := exec.CommandContext(ctx, s.kubectl, op.args(cluster, nil)...)
+	if op.TTY {
+		var err error
+		tty, err = startTTY(cmd)
+		if err != nil {
+			log.Printf("Falling back to exec without a terminal: %v", err)
+			op.TTY = false
+			cmd = exec.CommandContext(ctx, s.kubectl, op.args(cluster, nil)...)
+		} else {
+			defer tty.Close()
+			stdin = tty
+			outputs = []io.Reader{tty}
+		}
+	}
+	if !op.TTY {
+		in, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		stderr, err := cmd.StderrPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			send(streamMessage{Stream: streamError, Data: err.Error()})
+			return err
+		}
+		stdin = in
+		outputs = []io.Reader{stdout, stderr}
+	}
+
+	// The client going away ends the command, and the command ending closes
+	// the websocket.
+	go func() {
+		defer cancel()
+		for {
+			var msg streamMessage
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			switch msg.Stream {
+			case streamStdin:
+				if _, err := io.WriteString(stdin, msg.Data); err != nil {
+					return
+				}
+			case streamResize:
+				if tty != nil && msg.Cols > 0 && msg.Rows > 0 {
+					resizeTTY(tty, msg.Cols, msg.Rows)
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i, out := range outputs {
+		wg.Add(1)
+		go func(stream string, out io.Reader) {
+			defer wg.Done()
+			copyStream(out, func(data string) {
+				send(streamMessage{Stream: stream, Data: data})
+			})
+		}(streams[i], out)
+	}
+	wg.Wait()
+	if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+		send(streamMessage{Stream: streamError, Data: err.Error()})
+		return err
+	}
+	return nil
+}
+
+// copyStream reads r until it ends and passes what it reads to write, never
+// splitting a utf-8 character between calls.
+func copyStream(r io.Reader, write func(string)) {
+	buf := make([]byte, 32*1024)
+	pending := 0
+	for {
+		n, err := r.Read(buf[pending:])
+		n += pending
+		end := n
+		for i := n - 1; i >= 0 && i >= n-utf8.UTFMax; i-- {
+			if utf8.RuneStart(buf[i]) {
+				if !utf8.FullRune(buf[i:n]) {
+					end = i
+				}
+				break
+			}
+		}
+		if end > 0 {
+			write(string(buf[:end]))
+		}
+		pending = copy(buf, buf[end:n])
+		if err != nil {
+			if pending > 0 {
+				write(string(buf[:pending]))
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// kubeOp is a single kubectl operation requested by the frontend.  The server
+// builds the kubectl command line from it, so nothing the client sends is ever
+// passed to kubectl unchecked.
+type kubeOp struct {
+	// Op is one of create, apply, get, delete, scale, logs, exec or
+	// port-forward.
+	Op string `json:"op"`
+
+	// Cluster is the name of the target to run against, the first one if empty.
+	Cluster string `json:"cluster,omitempty"`
+
+	// Kind is the kind of object to get, delete, scale or get logs from.  The
+	// objects to create or apply are uploaded as files instead.
+	Kind      string            `json:"kind,omitempty"`
+	Name      string            `json:"name,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	Selector  map[string]string `json:"selector,omitempty"`
+
+	// If Watch is set then get streams changes instead of listing objects.
+	Watch bool `json:"watch,omitempty"`
+
+	// Replicas is only used when scaling.
+	Replicas *int `json:"replicas,omitempty"`
+
+	// The rest are only used for logs, and are the fields of PodLogOptions.
+	Container    string `json:"container,omitempty"`
+	Follow       bool   `json:"follow,omitempty"`
+	Previous     bool   `json:"previous,omitempty"`
+	SinceSeconds int64  `json:"sinceSeconds,omitempty"`
+	Timestamps   bool   `json:"timestamps,omitempty"`
+	TailLines    int    `json:"tailLines,omitempty"`
+	LimitBytes   int64  `json:"limitBytes,omitempty"`
+
+	// Command and TTY are only used for exec, which also uses Container.
+	Command []string `json:"command,omitempty"`
+	TTY     bool     `json:"tty,omitempty"`
+
+	// LocalPort and RemotePort are only used for port-forward.
+	LocalPort  int `json:"localPort,omitempty"`
+	RemotePort int `json:"remotePort,omitempty"`
+}
+
+// kindNames maps the ways kubectl lets a kind be spelled to the resource name
+// used for validation.
+var kindNames = map[string]string{
+	"service": "services", "services": "services", "svc": "services",
+	"endpoints": "endpoints", "ep": "endpoints",
+	"replicationcontroller": "replicationcontrollers", "replicationcontrollers": "replicationcontrollers", "rc": "replicationcontrollers",
+	"pod": "pods", "pods": "pods", "po": "pods",
+	"ingress": "ingresses", "ingresses": "ingresses", "ing": "ingresses",
+	"persistentvolumeclaim": "persistentvolumeclaims", "persistentvolumeclaims": "persistentvolumeclaims", "pvc": "persistentvolumeclaims",
+	"namespace": "namespaces", "namespaces": "namespaces", "ns": "namespaces",
+	"node": "nodes", "nodes": "nodes", "no": "nodes",
+	"event": "events", "events": "events", "ev": "events",
+}
+
+// objectKinds maps the kinds of object that may be created or applied to their
+// resource names.
+var objectKinds = map[string]string{
+	"Service":               "services",
+	"Endpoints":             "endpoints",
+	"ReplicationController": "replicationcontrollers",
+	"Ingress":               "ingresses",
+	"Namespace":             "namespaces",
+	"PersistentVolumeClaim": "persistentvolumeclaims",
+}
+
+// clusterScopedKinds are the resources that don't live in a namespace.
+var clusterScopedKinds = map[string]bool{"namespaces": true, "nodes": true}
+
+// opKinds lists the resources each operation may be used on.
+var opKinds = map[string]map[string]bool{
+	"get": {
+		"services": true, "endpoints": true, "replicationcontrollers": true, "pods": true, "ingresses": true,
+		"persistentvolumeclaims": true, "namespaces": true, "nodes": true, "events": true,
+	},
+	"delete": {
+		"services": true, "endpoints": true, "replicationcontrollers": true, "pods": true, "ingresses": true,
+		"persistentvolumeclaims": true, "namespaces": true,
+	},
+	"scale":        {"replicationcontrollers": true},
+	"logs":         {"pods": true},
+	"exec":         {"pods": true},
+	"port-forward": {"pods": true},
+}
+
+// nameRe matches DNS subdomains, which is what kubernetes requires of most
+// object names, and labelRe matches DNS labels, which is what it requires of
+// namespaces and container names.
+var nameRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+var labelRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+var selectorKeyRe = regexp.MustCompile(`^([a-z0-9]([-a-z0-9.]*[a-z0-9])?/)?[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+var selectorValueRe = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?)?$`)
+
+// stagingNameRe matches the names that uploaded files may be staged under.
+var stagingNameRe = regexp.MustCompile(`^[A-Za-z0-9][-A-Za-z0-9_.]*$`)
+
+// stagingName checks that an uploaded file's name is a plain file name, so
+// that it can't be written outside of the staging directory or be mistaken for
+// a kubectl flag.
+func stagingName(name string) (string, error) {
+	if len(name) > 255 || !stagingNameRe.MatchString(name) {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return name, nil
+}
+
+func validName(name string) bool {
+	return len(name) <= 253 && nameRe.MatchString(name)
+}
+
+func validLabel(label string) bool {
+	return len(label) <= 63 && labelRe.MatchString(label)
+}
+
+// kubeObject is the part of an uploaded object that's checked before it's
+// given to kubectl.
+type kubeObject struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+}
+
+// validate checks op and any uploaded objects, normalizing op.Kind and filling
+// in op.Namespace with defaultNamespace if it's needed, and returns the
+// namespaces that the operation touches.  An empty namespace means
+// cluster-wide objects.
+func (op *kubeOp) validate(files map[string][]byte, defaultNamespace string) ([]string, error) {
+	if op.Namespace != "" && !validLabel(op.Namespace) {
+		return nil, fmt.Errorf("invalid namespace %q", op.Namespace)
+	}
+
+	switch op.Op {
+	case "create", "apply":
+		if len(files) == 0 {
+			return nil, fmt.Errorf("%s requires at least one object", op.Op)
+		}
+		var objs []kubeObject
+		for name, data := range files {
+			var obj kubeObject
+			if err := json.Unmarshal(data, &obj); err != nil {
+				return nil, fmt.Errorf("unable to parse %s: %v", name, err)
+			}
+			if _, ok := objectKinds[obj.Kind]; !ok {
+				return nil, fmt.Errorf("may not %s a %q", op.Op, obj.Kind)
+			}
+			if !validName(obj.Metadata.Name) {
+				return nil, fmt.Errorf("invalid %s name %q", obj.Kind, obj.Metadata.Name)
+			}
+			switch {
+			case obj.Kind == "Namespace":
+				if !validLabel(obj.Metadata.Name) {
+					return nil, fmt.Errorf("invalid namespace %q", obj.Metadata.Name)
+				}
+			case obj.Metadata.Namespace == "":
+			case !validLabel(obj.Metadata.Namespace):
+				return nil, fmt.Errorf("invalid namespace %q", obj.Metadata.Namespace)
+			case op.Namespace == "":
+				op.Namespace = obj.Metadata.Namespace
+			case obj.Metadata.Namespace != op.Namespace:
+				return nil, fmt.Errorf("%s %s is in namespace %s, not %s", obj.Kind, obj.Metadata.Name, obj.Metadata.Namespace, op.Namespace)
+			}
+			objs = append(objs, obj)
+		}
+		if op.Namespace == "" {
+			op.Namespace = defaultNamespace
+		}
+		var namespaces []string
+		for _, obj := range objs {
+			if obj.Kind == "Namespace" {
+				namespaces = append(namespaces, obj.Metadata.Name)
+			} else {
+				namespaces = append(namespaces, op.Namespace)
+			}
+		}
+		return namespaces, nil
+
+	case "get", "delete", "scale", "logs", "exec", "port-forward":
+		if len(files) > 0 {
+			return nil, fmt.Errorf("%s doesn't take any objects", op.Op)
+		}
+		kind, ok := kindNames[strings.ToLower(op.Kind)]
+		if !ok || !opKinds[op.Op][kind] {
+			return nil, fmt.Errorf("may not %s %q", op.Op, op.Kind)
+		}
+		op.Kind = kind
+	default:
+		return nil, fmt.Errorf("unknown operation %q", op.Op)
+	}
+
+	if op.Name != "" && !validName(op.Name) {
+		return nil, fmt.Errorf("invalid name %q", op.Name)
+	}
+	for k, v := range op.Selector {
+		if !selectorKeyRe.MatchString(k) || !selectorValueRe.MatchString(v) {
+			return nil, fmt.Errorf("invalid selector %s=%s", k, v)
+		}
+	}
+	if op.Container != "" && !validLabel(op.Container) {
+		return nil, fmt.Errorf("invalid container %q", op.Container)
+	}
+	if op.TailLines < 0 || op.SinceSeconds < 0 || op.LimitBytes < 0 {
+		return nil, fmt.Errorf("tail lines, since seconds and limit bytes can't be negative")
+	}
+	if op.Watch && op.Op != "get" {
+		return nil, fmt.Errorf("only get can watch")
+	}
+	switch op.Op {
+	case "delete":
+		if op.Name == "" && len(op.Selector) == 0 {
+			return nil, fmt.Errorf("delete requires a name or a selector")
+		}
+		if op.Kind == "namespaces" && op.Name == "" {
+			return nil, fmt.Errorf("namespaces may only be deleted by name")
+		}
+	case "scale":
+		if op.Name == "" || op.Replicas == nil || *op.Replicas < 0 {
+			return nil, fmt.Errorf("scale requires a name and a number of replicas")
+		}
+	case "logs", "exec", "port-forward":
+		if op.Name == "" && len(op.Selector) == 0 {
+			return nil, fmt.Errorf("%s requires a pod name or a selector", op.Op)
+		}
+	}
+	if op.Op == "exec" {
+		if len(op.Command) == 0 {
+			op.Command = []string{"/bin/sh"}
+		}
+		for _, arg := range op.Command {
+			if arg == "" || strings.ContainsRune(arg, 0) {
+				return nil, fmt.Errorf("invalid command %q", op.Command)
+			}
+		}
+	}
+	if op.Op == "port-forward" {
+		if op.RemotePort < 1 || op.RemotePort > 65535 || op.LocalPort < 0 || op.LocalPort > 65535 {
+			return nil, fmt.Errorf("invalid ports %d:%d", op.LocalPort, op.RemotePort)
+		}
+	}
+
+	switch {
+	case op.Kind == "namespaces" && op.Name != "":
+		if !validLabel(op.Name) {
+			return nil, fmt.Errorf("invalid namespace %q", op.Name)
+		}
+		return []string{op.Name}, nil
+	case clusterScopedKinds[op.Kind]:
+		return []string{""}, nil
+	}
+	if op.Namespace == "" {
+		op.Namespace = defaultNamespace
+	}
+	return []string{op.Namespace}, nil
+}
+
+// args returns the kubectl arguments for running op, which must have been
+// validated, against cluster.  files are the names of the staged objects to
+// create or apply.
+func (op *kubeOp) args(cluster *clusterTarget, files []string) []string {
+	args := append(cluster.args(), op.Op)
+	switch op.Op {
+	case "create", "apply":
+		sort.Strings(files)
+		for _, file := range files {
+			args = append(args, "-f", file)
+		}
+	case "exec":
+		args = append(args, "-i")
+		if op.TTY {
+			args = append(args, "-t")
+		}
+		args = append(args, op.Name)
+		if op.Container != "" {
+			args = append(args, "-c", op.Container)
+		}
+	case "port-forward":
+		args = append(args, op.Name, fmt.Sprintf("%d:%d", op.LocalPort, op.RemotePort))
+	case "logs":
+		// Without a name kubectl picks the pods by the selector below.
+		if op.Name != "" {
+			args = append(args, op.Name)
+		}
+		if op.Container != "" {
+			args = append(args, "-c", op.Container)
+		}
+		if op.Follow {
+			args = append(args, "--follow")
+		}
+		if op.Previous {
+			args = append(args, "--previous")
+		}
+		if op.SinceSeconds > 0 {
+			args = append(args, fmt.Sprintf("--since=%ds", op.SinceSeconds))
+		}
+		if op.Timestamps {
+			args = append(args, "--timestamps")
+		}
+		if op.TailLines > 0 {
+			args = append(args, fmt.Sprintf("--tail=%d", op.TailLines))
+		}
+		if op.LimitBytes > 0 {
+			args = append(args, fmt.Sprintf("--limit-bytes=%d", op.LimitBytes))
+		}
+	default:
+		args = append(args, op.Kind)
+		if op.Name != "" {
+			args = append(args, op.Name)
+		}
+	}
+	if len(op.Selector) > 0 {
+		var sel []string
+		for k, v := range op.Selector {
+			sel = append(sel, fmt.Sprintf("%s=%s", k, v))
+		}
+		sort.Strings(sel)
+		args = append(args, "-l", strings.Join(sel, ","))
+	}
+	switch op.Op {
+	case "get":
+		if op.Watch {
+			args = append(args, "--watch-only")
+		}
+		args = append(args, "-o", "json")
+	case "scale":
+		args = append(args, fmt.Sprintf("--replicas=%d", *op.Replicas))
+	}
+	if op.Namespace != "" && !clusterScopedKinds[op.Kind] {
+		args = append(args, "--namespace="+op.Namespace)
+	}
+	if op.Op == "exec" {
+		args = append(append(args, "--"), op.Command...)
+	}
+	return args
+}
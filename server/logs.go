@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// logsOp makes the logs operation described by the query q.  The pods to get
+// logs from are given by name or by a selector, e.g. selector=flow-id=web, and
+// the other parameters are the fields of PodLogOptions.
+func logsOp(q url.Values) (*kubeOp, error) {
+	op := &kubeOp{
+		Op:        "logs",
+		Kind:      "pods",
+		Cluster:   q.Get("cluster"),
+		Name:      q.Get("name"),
+		Namespace: q.Get("namespace"),
+		Container: q.Get("container"),
+	}
+	selector, err := querySelector(q)
+	if err != nil {
+		return nil, err
+	}
+	op.Selector = selector
+	for name, b := range map[string]*bool{"follow": &op.Follow, "previous": &op.Previous, "timestamps": &op.Timestamps} {
+		if v := q.Get(name); v != "" {
+			var err error
+			if *b, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("invalid %s %q", name, v)
+			}
+		}
+	}
+	for name, n := range map[string]*int64{"sinceSeconds": &op.SinceSeconds, "limitBytes": &op.LimitBytes} {
+		if v := q.Get(name); v != "" {
+			var err error
+			if *n, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid %s %q", name, v)
+			}
+		}
+	}
+	if v := q.Get("tailLines"); v != "" {
+		var err error
+		if op.TailLines, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid tailLines %q", v)
+		}
+	}
+	return op, nil
+}
+
+// querySelector returns the label selector given as selector=k=v,... in q, or
+// nil if there isn't one.
+func querySelector(q url.Values) (map[string]string, error) {
+	sel := q.Get("selector")
+	if sel == "" {
+		return nil, nil
+	}
+	selector := make(map[string]string)
+	for _, term := range strings.Split(sel, ",") {
+		parts := strings.SplitN(term, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid selector %q, it must be key=value[,key=value...]", sel)
+		}
+		selector[parts[0]] = parts[1]
+	}
+	return selector, nil
+}
+
+// handleLogs streams the logs of every pod asked for, see logsOp.  Each line is
+// prefixed with the name of the pod it came from, and following stops when the
+// client goes away.
+func (s *server) handleLogs(w http.ResponseWriter, r *http.Request, user string) error {
+	op, err := logsOp(r.URL.Query())
+	if err != nil {
+		return err
+	}
+	cluster, err := s.cluster(op.Cluster)
+	if err != nil {
+		return err
+	}
+	if _, err := op.validate(nil, cluster.namespace()); err != nil {
+		return err
+	}
+	if err := s.perms.check(user, cluster.Name, op.Op, op.Namespace); err != nil {
+		log.Printf("Refusing logs: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil
+	}
+
+	ctx := r.Context()
+	pods := []string{op.Name}
+	if op.Name == "" {
+		pods, err = s.podNames(ctx, cluster, op.Namespace, op.Selector)
+		if err != nil {
+			return err
+		}
+		if len(pods) == 0 {
+			http.Error(w, "no pods match", http.StatusNotFound)
+			return nil
+		}
+	}
+	log.Printf("%s is reading logs of %s in %s on %s", user, strings.Join(pods, ", "), op.Namespace, cluster.Name)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	var mu sync.Mutex
+	writeLine := func(pod, line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, "[%s] %s\n", pod, line)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, pod := range pods {
+		podOp := *op
+		podOp.Name = pod
+		podOp.Selector = nil
+		wg.Add(1)
+		go func(pod string) {
+			defer wg.Done()
+			if err := streamLines(exec.CommandContext(ctx, s.kubectl, podOp.args(cluster, nil)...), func(line string) {
+				writeLine(pod, line)
+			}); err != nil && ctx.Err() == nil {
+				writeLine(pod, fmt.Sprintf("FAIL: %v", err))
+			}
+		}(pod)
+	}
+	wg.Wait()
+	return nil
+}
+
+// streamLines runs cmd and calls line for each line that it outputs.
+func streamLines(cmd *exec.Cmd, line func(string)) error {
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(out)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line(scanner.Text())
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return scanner.Err()
+}
+
+// podNames returns the names of the pods in namespace that match selector.
+func (s *server) podNames(ctx context.Context, cluster *clusterTarget, namespace string, selector map[string]string) ([]string, error) {
+	op := &kubeOp{Op: "get", Kind: "pods", Namespace: namespace, Selector: selector}
+	output, err := exec.CommandContext(ctx, s.kubectl, op.args(cluster, nil)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pods: %v", err)
+	}
+	var pods struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(output, &pods); err != nil {
+		return nil, fmt.Errorf("unable to parse pods: %v", err)
+	}
+	var names []string
+	for _, pod := range pods.Items {
+		names = append(names, pod.Metadata.Name)
+	}
+	return names, nil
+}
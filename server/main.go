@@ -1,12 +1,8 @@
 package main
 
 import (
-	"archive/tar"
 	"bytes"
-	"compress/gzip"
 	"encoding/json"
-	"encoding/xml"
-	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -17,53 +13,238 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
-	"sync"
-
-	"github.com/appc/spec/schema"
-)
-
-var (
-	kubectlBin = flag.String("kubectl", "/home/jwills/kubernetes/client/bin/kubectl", "Path to kubectl binary.")
 )
 
 func main() {
-	flag.Parse()
-	if *kubectlBin == "" {
-		log.Fatalf("Must specify kubectl binary with --kubectl.")
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	log.Printf("Running kubectl from %s", cfg.Kubectl)
+	if cfg.Discovery.Insecure {
+		log.Printf("WARNING: image discovery may fall back to plain http")
+	}
+	if err := os.MkdirAll(cfg.StorageDir, 0700); err != nil {
+		log.Fatalf("Unable to create storage dir: %v", err)
+	}
+	auth, err := newAuthenticator(cfg.Auth.Mode, cfg.Auth.Tokens, cfg.Auth.Htpasswd, cfg.Auth.Header, cfg.Auth.TrustedProxies)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if cfg.Auth.Mode == "none" {
+		log.Printf("WARNING: authentication is disabled, anyone who can reach the server can use the cluster")
+	}
+	perms, err := loadPermissions(cfg.Auth.Permissions)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	clusters := cfg.Clusters
+	if len(clusters) == 0 {
+		clusters, err = loadClusters(cfg.ClustersFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	keys, err := loadTrustedKeys(cfg.Discovery.TrustedKeys)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cache, err := openImageCache(cfg.Discovery.CacheDir, cfg.Discovery.CacheSize)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	var bases, catalogs []string
+	var reg *registry
+	if cfg.Discovery.RegistryDir != "" {
+		reg, err = openRegistry(cfg.Discovery.RegistryDir)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		bases = append(bases, "http://"+localRegistryHost+strings.TrimSuffix(registryPrefix, "/"))
+	}
+	bases = append(bases, cfg.Discovery.Registries...)
+	catalogs = append(catalogs, cfg.Discovery.Registries...)
+	ui, err := uiFiles(cfg.StaticDir)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if cfg.StaticDir != "" {
+		log.Printf("Serving the UI from %s", cfg.StaticDir)
 	}
-	log.Printf("Running kubectl from %s", *kubectlBin)
+	transport := &localTransport{next: http.DefaultTransport}
+	if reg != nil {
+		transport.handler = http.StripPrefix(strings.TrimSuffix(registryPrefix, "/"), reg)
+	}
+	client := &http.Client{Transport: transport}
 	s := &server{
-		kubectl: *kubectlBin,
-		files:   http.FileServer(http.Dir(".")),
+		kubectl:        cfg.Kubectl,
+		clusters:       clusters,
+		files:          http.StripPrefix(strings.TrimSuffix(uiPrefix, "/"), http.FileServer(ui)),
+		auth:           auth,
+		perms:          perms,
+		allowedOrigins: cfg.Auth.AllowedOrigins,
+		discovery: &discoverer{
+			client:     client,
+			insecure:   cfg.Discovery.Insecure,
+			registries: bases,
+		},
+		verifier: &verifier{
+			client:          client,
+			trusted:         keys,
+			trustDiscovered: cfg.Discovery.TrustDiscoveredKeys,
+			results:         make(map[string]*signatureInfo),
+		},
+		cache:             cache,
+		registry:          reg,
+		catalogs:          catalogs,
+		ociDir:            cfg.Discovery.OCIDir,
+		maxImageSize:      cfg.Discovery.MaxImageSize,
+		requireSignatures: cfg.Discovery.RequireSignatures,
+	}
+	if cfg.TLS.Cert != "" {
+		log.Printf("serving https on %s", cfg.Listen)
+		log.Fatal(http.ListenAndServeTLS(cfg.Listen, cfg.TLS.Cert, cfg.TLS.Key, s))
 	}
-	log.Printf("serving")
-	log.Fatal(http.ListenAndServe(":9090", s))
+	log.Printf("serving on %s", cfg.Listen)
+	log.Fatal(http.ListenAndServe(cfg.Listen, s))
 }
 
 type server struct {
-	kubectl string
-	files   http.Handler
-	kubeMu  sync.Mutex
+	kubectl   string
+	clusters  []*clusterTarget
+	files     http.Handler
+	discovery *discoverer
+	verifier  *verifier
+	cache     *imageCache
+
+	auth  authenticator
+	perms *permissions
+
+	// forwards are the port-forwards that users have started.
+	forwards portForwards
+
+	// allowedOrigins may make cross-origin requests, nothing else may.
+	allowedOrigins []string
+
+	// registry is nil unless a directory of images is being served.
+	registry *registry
+
+	// catalogs are registries whose catalogs are merged into ours.
+	catalogs []string
+
+	// ociDir holds OCI image layouts, one per directory.
+	ociDir string
+
+	// maxImageSize is the largest image that will be downloaded.
+	maxImageSize int64
+
+	// If requireSignatures is set then images that can't be verified are
+	// refused rather than flagged.
+	requireSignatures bool
+}
+
+// containerInfo is what the server responds with when asked for a container.
+// Docker and OCI images are converted to the equivalent appc manifest.
+type containerInfo struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature signatureInfo   `json:"signature"`
+
+	// Image is the reference the cluster should pull, if it's known.
+	Image string `json:"image"`
+
+	// If set, Undeployable is why the cluster can't run the image at all.
+	Undeployable string `json:"undeployable,omitempty"`
+
+	// Layers is every image that the container depends on, directly or not.
+	Layers []layerInfo `json:"layers,omitempty"`
 }
 
 const containerPrefix = "/container/"
+const dockerPrefix = "/container/docker/"
+const ociPrefix = "/container/oci/"
 const uiPrefix = "/_html/"
 const kubectlPrefix = "/kubectl/"
+const registryPrefix = "/registry/"
+const catalogPrefix = "/catalog/"
+const clustersPrefix = "/clusters/"
+const logsPrefix = "/logs/"
+const eventsPrefix = "/events/"
+const execPrefix = "/exec/"
+const portForwardPrefix = "/portforward/"
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Get request: %v", r.URL.String())
-	w.Header().Add("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
+	// Browsers send cookies and basic auth credentials along with cross-site
+	// requests, so anything that can change something has to come from us.
+	if r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" {
+		if err := s.sameOrigin(r); err != nil {
+			log.Printf("Refusing %s request for %v: %v", r.Method, r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	user, err := s.auth.authenticate(w, r)
+	if err != nil {
+		log.Printf("Refusing request for %v: %v", r.URL.Path, err)
+		s.auth.challenge(w)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	log.Printf("Get request from %s: %v", user, r.URL.Path)
 	switch {
 	case strings.HasPrefix(r.URL.String(), containerPrefix):
 		if err := s.handleContainer(w, r); err != nil {
 			log.Printf("Failed for: %v", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+
+	case strings.HasPrefix(r.URL.String(), catalogPrefix):
+		if err := s.handleCatalog(w, r); err != nil {
+			log.Printf("Failed for: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 
 	case strings.HasPrefix(r.URL.String(), uiPrefix):
 		s.files.ServeHTTP(w, r)
 
 	case strings.HasPrefix(r.URL.String(), kubectlPrefix):
-		s.handleKubectl(w, r)
+		s.handleKubectl(w, r, user)
+
+	case strings.HasPrefix(r.URL.String(), logsPrefix):
+		if err := s.handleLogs(w, r, user); err != nil {
+			log.Printf("Failed for: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+
+	case strings.HasPrefix(r.URL.String(), eventsPrefix):
+		if err := s.handleEvents(w, r, user); err != nil {
+			log.Printf("Failed for: %v", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+
+	case strings.HasPrefix(r.URL.String(), execPrefix):
+		if err := s.handleExec(w, r, user); err != nil {
+			log.Printf("Failed for: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+
+	case strings.HasPrefix(r.URL.String(), portForwardPrefix):
+		if err := s.handlePortForward(w, r, user); err != nil {
+			log.Printf("Failed for: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+
+	case strings.HasPrefix(r.URL.String(), clustersPrefix):
+		if err := s.handleClusters(w, r, user); err != nil {
+			log.Printf("Failed for: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	case s.registry != nil && strings.HasPrefix(r.URL.String(), registryPrefix):
+		http.StripPrefix(strings.TrimSuffix(registryPrefix, "/"), s.registry).ServeHTTP(w, r)
 
 	default:
 		http.NotFound(w, r)
@@ -73,93 +254,81 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 var containerRe = regexp.MustCompile(`/container/([^/]+)/([^:]+)(:(.*))?`)
 
-func (s *server) handleContainer(w http.ResponseWriter, r *http.Request) error {
+// requestLabelNames are the query parameters that are taken as labels.  Other
+// parameters, like the token used to log in, must not end up in the labels,
+// which are logged and are part of cache keys.
+var requestLabelNames = []string{"version", "os", "arch"}
+
+// requestLabels returns the labels to find an image with, which default to
+// linux/amd64 and can be set with query parameters.
+func requestLabels(r *http.Request) map[string]string {
+	labels := map[string]string{
+		"os":   "linux",
+		"arch": "amd64",
+	}
+	query := r.URL.Query()
+	for _, k := range requestLabelNames {
+		if v := query.Get(k); v != "" {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// parseContainerRequest pulls the app to discover out of a request for
+// /container/<domain>/<path>[:<version>].  The version, os and arch query
+// parameters are used as labels.
+func parseContainerRequest(r *http.Request) (discoveryApp, error) {
 	matches := containerRe.FindStringSubmatch(r.URL.Path)
 	if len(matches) != 5 {
-		return fmt.Errorf("didn't match container regex")
+		return discoveryApp{}, fmt.Errorf("didn't match container regex")
 	}
-	domain := matches[1]
-	name := domain + "/" + matches[2]
-	version := matches[4]
-	if version == "" {
-		version = "latest"
+	app := discoveryApp{
+		name:   matches[1] + "/" + matches[2],
+		labels: requestLabels(r),
 	}
-	fmt.Printf("%s %s %s\n", domain, name, version)
-	resp, err := http.Get(fmt.Sprintf("https://%s/meta/meta.html", domain))
-	if err != nil {
-		return err
+	if app.labels["version"] == "" {
+		app.labels["version"] = matches[4]
 	}
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
+	if app.labels["version"] == "" {
+		app.labels["version"] = "latest"
 	}
-	log.Printf("meta: %s", data)
-	var x xHTML
-	if err := xml.Unmarshal([]byte(data), &x); err != nil {
-		log.Printf("err unmarshaling meta data: %v", err)
+	return app, nil
+}
+
+// handleContainer responds with the manifest of an ACI, or of a docker or OCI
+// image converted to look like one.
+func (s *server) handleContainer(w http.ResponseWriter, r *http.Request) error {
+	var info *containerInfo
+	var err error
+	switch {
+	case strings.HasPrefix(r.URL.Path, dockerPrefix):
+		info, err = s.dockerContainer(strings.TrimPrefix(r.URL.Path, dockerPrefix), requestLabels(r))
+	case strings.HasPrefix(r.URL.Path, ociPrefix):
+		info, err = s.ociContainer(strings.TrimPrefix(r.URL.Path, ociPrefix), requestLabels(r))
+	default:
+		info, err = s.aciContainer(r)
 	}
-	log.Printf("meta: %v", x)
-	var target string
-	for _, meta := range x.Metas {
-		if meta.Name != "ac-discovery" {
-			continue
-		}
-		fields := strings.Fields(meta.Content)
-		if len(fields) != 2 {
-			continue
-		}
-		if !strings.HasPrefix(name, fields[0]) {
-			continue
-		}
-		tmpl := fields[1]
-		tmpl = strings.Replace(tmpl, "{name}", name, -1)
-		tmpl = strings.Replace(tmpl, "{os}", "linux", -1)
-		tmpl = strings.Replace(tmpl, "{arch}", "amd64", -1)
-		tmpl = strings.Replace(tmpl, "{version}", version, -1)
-		tmpl = strings.Replace(tmpl, "{ext}", "aci", -1)
-		target = tmpl
-		break
-	}
-	if target == "" {
-		return fmt.Errorf("didn't find the appropriate discovery meta")
-	}
-	log.Printf("%s", target)
-	resp, err = http.Get(target)
 	if err != nil {
-		return fmt.Errorf("unable to find container: %v")
+		return err
 	}
-	data, err = ioutil.ReadAll(resp.Body)
+	return json.NewEncoder(w).Encode(info)
+}
+
+func (s *server) aciContainer(r *http.Request) (*containerInfo, error) {
+	app, err := parseContainerRequest(r)
 	if err != nil {
-		return fmt.Errorf("unable to read response from server: %v")
+		return nil, err
 	}
-	buf := bytes.NewBuffer(data)
-	if gzr, err := gzip.NewReader(buf); err == nil {
-		if unzipped, err := ioutil.ReadAll(gzr); err == nil {
-			data = unzipped
-		}
-	}
-	tr := tar.NewReader(bytes.NewBuffer(data))
-	var manifest []byte
-	for header, err := tr.Next(); err == nil; header, err = tr.Next() {
-		if header == nil {
-			break
-		}
-		if header.Name != "manifest" {
-			continue
-		}
-		manifest, _ = ioutil.ReadAll(tr)
-	}
-	if manifest == nil {
-		return fmt.Errorf("unable to read manifest")
-	}
-	var im schema.ImageManifest
-	if err := json.Unmarshal(manifest, &im); err != nil {
-		return fmt.Errorf("unable to parse manifest")
+	log.Printf("Discovering %s", app)
+	_, sig, manifest, im, err := s.loadImage(app, false)
+	if err != nil {
+		return nil, err
 	}
 	imIndent, _ := json.MarshalIndent(im, "", "  ")
 	log.Printf("%s\n", imIndent)
 	if im.App == nil {
-		return fmt.Errorf("no app section defined")
+		return nil, fmt.Errorf("no app section defined")
 	}
 	for _, mp := range im.App.MountPoints {
 		log.Printf("Mount point: %v", mp.Name)
@@ -167,15 +336,31 @@ func (s *server) handleContainer(w http.ResponseWriter, r *http.Request) error {
 	for _, port := range im.App.Ports {
 		log.Printf("Port: %v@%d", port.Name, port.Port)
 	}
-	io.Copy(w, bytes.NewBuffer(manifest))
-	return nil
+	layers := s.resolveDependencies(app, im)
+	for _, layer := range layers {
+		if layer.Error != "" {
+			log.Printf("WARNING: %s: %s", layer.Name, layer.Error)
+		}
+	}
+	info := &containerInfo{
+		Manifest:  manifest,
+		Signature: *sig,
+		Layers:    layers,
+	}
+	// Without a version there's no reference to give, so the frontend's
+	// default is used instead.
+	if version, ok := im.Labels.Get("version"); ok && version != "" {
+		info.Image = fmt.Sprintf("%s:%s", im.Name, version)
+	}
+	return info, nil
 }
 
-func (s *server) handleKubectl(w http.ResponseWriter, r *http.Request) {
+func (s *server) handleKubectl(w http.ResponseWriter, r *http.Request, user string) {
 	if err := r.ParseMultipartForm(10000000); err != nil {
 		fmt.Fprintf(w, "FAIL: Failed to parse multipart form: %v", err)
 		return
 	}
+	defer r.MultipartForm.RemoveAll()
 
 	// Read all files
 	fileData := make(map[string][]byte)
@@ -187,54 +372,92 @@ func (s *server) handleKubectl(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			data, err := ioutil.ReadAll(reader)
+			reader.Close()
 			if err != nil {
 				fmt.Fprintf(w, "FAIL: failed to read file %v: %v", header.Filename, err)
 				return
 			}
-			if _, ok := fileData[header.Filename]; ok {
-				fmt.Fprintf(w, "FAIL: more than one file per filename (%s) is not supported", header.Filename)
+			name, err := stagingName(header.Filename)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("FAIL: %v", err), http.StatusBadRequest)
 				return
 			}
-			fileData[header.Filename] = data
+			if _, ok := fileData[name]; ok {
+				fmt.Fprintf(w, "FAIL: more than one file per filename (%s) is not supported", name)
+				return
+			}
+			fileData[name] = data
 		}
 	}
 
-	s.kubeMu.Lock()
-	defer s.kubeMu.Unlock()
-
-	id := "kubeflow"
-	dir := filepath.Join(os.TempDir(), fmt.Sprintf("%s", id))
-	if err := os.MkdirAll(dir, 0777); err != nil {
-		fmt.Fprintf(w, "FAIL: failed to create temporary directory, %s, for staging files: %v", dir, err)
+	var op kubeOp
+	if err := json.Unmarshal([]byte(r.FormValue("op")), &op); err != nil {
+		http.Error(w, fmt.Sprintf("FAIL: unable to parse operation: %v", err), http.StatusBadRequest)
 		return
 	}
-	defer os.RemoveAll(dir)
-
-	pwd, err := os.Getwd()
+	// Operations that stream never finish by themselves, so they have their own
+	// endpoints that stop them when the client goes away.
+	var streaming string
+	switch {
+	case op.Op == "exec":
+		streaming = execPrefix
+	case op.Op == "port-forward":
+		streaming = portForwardPrefix
+	case op.Follow:
+		streaming = logsPrefix
+	case op.Watch:
+		streaming = eventsPrefix
+	}
+	if streaming != "" {
+		http.Error(w, fmt.Sprintf("FAIL: %s streams, use %s", op.Op, streaming), http.StatusBadRequest)
+		return
+	}
+	cluster, err := s.cluster(op.Cluster)
 	if err != nil {
-		fmt.Fprintf(w, "FAIL: unable to get pwd: %v", err)
+		http.Error(w, fmt.Sprintf("FAIL: %v", err), http.StatusBadRequest)
 		return
 	}
-	if err := os.Chdir(dir); err != nil {
-		fmt.Fprintf(w, "FAIL: unable to chdir to %s: %v", dir, err)
+	namespaces, err := op.validate(fileData, cluster.namespace())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("FAIL: %v", err), http.StatusBadRequest)
 		return
 	}
-	defer os.Chdir(pwd)
+	for _, ns := range namespaces {
+		if err := s.perms.check(user, cluster.Name, op.Op, ns); err != nil {
+			log.Printf("Refusing kubectl %s: %v", op.Op, err)
+			http.Error(w, fmt.Sprintf("FAIL: %v", err), http.StatusForbidden)
+			return
+		}
+	}
+	var files []string
+	for name := range fileData {
+		files = append(files, name)
+	}
+	args := op.args(cluster, files)
+	log.Printf("%s is running kubectl %s on %s", user, strings.Join(args, " "), cluster.Name)
 
+	// Every request gets its own directory so that concurrent requests can't
+	// see or clobber each other's files.
+	dir, err := ioutil.TempDir("", "kubeflow")
+	if err != nil {
+		fmt.Fprintf(w, "FAIL: failed to create temporary directory for staging files: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
 	log.Printf("Using temp dir: %v", dir)
 
 	// Write all the files
 	for name, data := range fileData {
 		log.Printf("File: %q", name)
 		log.Printf("%s", data)
-		if err := ioutil.WriteFile(name, data, 0777); err != nil {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
 			fmt.Fprintf(w, "FAIL: failed to write temporary file %s: %v", name, err)
 			return
 		}
 	}
 
-	cmdVals := strings.Fields(r.FormValue("cmd"))
-	cmd := exec.Command(s.kubectl, cmdVals...)
+	cmd := exec.CommandContext(r.Context(), s.kubectl, args...)
+	cmd.Dir = dir
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		fmt.Fprintf(w, "FAIL:")
@@ -242,12 +465,3 @@ func (s *server) handleKubectl(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, bytes.NewBuffer(output))
 	io.Copy(os.Stdout, bytes.NewBuffer(output))
 }
-
-type xHTML struct {
-	XMLName xml.Name `xml:"html"`
-	Metas   []xMeta  `xml:"head>meta"`
-}
-type xMeta struct {
-	Name    string `xml:"name,attr"`
-	Content string `xml:"content,attr"`
-}
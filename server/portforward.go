@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// portForwardTimeout is how long kubectl has to start forwarding.
+const portForwardTimeout = 20 * time.Second
+
+// maxPortForwards is how many sessions a user may have running at once.
+const maxPortForwards = 10
+
+// portForward is a running kubectl port-forward.  The local port is on the
+// server's loopback interface, so it can only be reached from the server
+// itself, e.g. through an ssh tunnel, and anything that can open connections
+// there can use it.
+type portForward struct {
+	ID         string    `json:"id"`
+	Cluster    string    `json:"cluster"`
+	Namespace  string    `json:"namespace"`
+	Pod        string    `json:"pod"`
+	RemotePort int       `json:"remotePort"`
+	LocalPort  int       `json:"localPort"`
+	Started    time.Time `json:"started"`
+
+	// Selector is what the pod was picked by, if it wasn't named.
+	Selector map[string]string `json:"selector,omitempty"`
+
+	user   string
+	cancel context.CancelFunc
+}
+
+// portForwards are the running sessions of every user.
+type portForwards struct {
+	mu       sync.Mutex
+	sessions map[string]*portForward
+	next     int
+
+	// starting counts each user's sessions that aren't forwarding yet.
+	starting map[string]int
+}
+
+// handlePortForward manages the user's port-forward sessions.  POSTing a
+// port-forward kubeOp starts one, GET lists them and DELETE /portforward/<id>
+// stops one.
+func (s *server) handlePortForward(w http.ResponseWriter, r *http.Request, user string) error {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(s.forwards.list(user))
+
+	case "POST":
+		var op kubeOp
+		if err := json.NewDecoder(r.Body).Decode(&op); err != nil {
+			return fmt.Errorf("unable to parse port-forward: %v", err)
+		}
+		op.Op = "port-forward"
+		op.Kind = "pods"
+		op.LocalPort = 0
+		cluster, err := s.cluster(op.Cluster)
+		if err != nil {
+			return err
+		}
+		if _, err := op.validate(nil, cluster.namespace()); err != nil {
+			return err
+		}
+		if err := s.perms.check(user, cluster.Name, op.Op, op.Namespace); err != nil {
+			log.Printf("Refusing port-forward: %v", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return nil
+		}
+		selector := op.Selector
+		if err := s.resolvePod(r.Context(), cluster, &op); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return nil
+		}
+		pf, err := s.startPortForward(user, cluster, &op, selector)
+		if err != nil {
+			return err
+		}
+		log.Printf("%s is forwarding localhost:%d to %s/%s:%d on %s", user, pf.LocalPort, pf.Namespace, pf.Pod, pf.RemotePort, pf.Cluster)
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(pf)
+
+	case "DELETE":
+		id := strings.TrimPrefix(r.URL.Path, portForwardPrefix)
+		if !s.forwards.stop(user, id) {
+			http.Error(w, fmt.Sprintf("no port-forward %q", id), http.StatusNotFound)
+		}
+		return nil
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+}
+
+// startPortForward runs kubectl port-forward for op on a free local port, and
+// returns once it's forwarding.  The session, which records selector, lasts
+// until it's stopped or kubectl exits.
+func (s *server) startPortForward(user string, cluster *clusterTarget, op *kubeOp, selector map[string]string) (*portForward, error) {
+	if !s.forwards.reserve(user) {
+		return nil, fmt.Errorf("%s already has %d port-forwards running", user, maxPortForwards)
+	}
+	added := false
+	defer func() {
+		if !added {
+			s.forwards.release(user)
+		}
+	}()
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	op.LocalPort = port
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, s.kubectl, op.args(cluster, nil)...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+	ready := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(out)
+		forwarding := false
+		for scanner.Scan() {
+			if !forwarding && strings.HasPrefix(scanner.Text(), "Forwarding from") {
+				forwarding = true
+				close(ready)
+			}
+		}
+		done <- cmd.Wait()
+	}()
+	select {
+	case <-ready:
+	case err := <-done:
+		cancel()
+		return nil, fmt.Errorf("port-forward failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	case <-time.After(portForwardTimeout):
+		cancel()
+		<-done
+		return nil, fmt.Errorf("port-forward didn't start within %v", portForwardTimeout)
+	}
+
+	pf := &portForward{
+		Cluster:    cluster.Name,
+		Namespace:  op.Namespace,
+		Pod:        op.Name,
+		RemotePort: op.RemotePort,
+		LocalPort:  op.LocalPort,
+		Started:    time.Now(),
+		Selector:   selector,
+		user:       user,
+		cancel:     cancel,
+	}
+	s.forwards.add(pf)
+	added = true
+	go func() {
+		err := <-done
+		log.Printf("Port-forward %s to %s/%s:%d ended: %v", pf.ID, pf.Namespace, pf.Pod, pf.RemotePort, err)
+		s.forwards.stop(user, pf.ID)
+	}()
+	return pf, nil
+}
+
+// freePort returns a local port that nothing is listening on.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("unable to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// reserve claims one of user's maxPortForwards sessions, and reports whether
+// there was one left.  The session is then either added or released.
+func (pfs *portForwards) reserve(user string) bool {
+	pfs.mu.Lock()
+	defer pfs.mu.Unlock()
+	n := pfs.starting[user]
+	for _, pf := range pfs.sessions {
+		if pf.user == user {
+			n++
+		}
+	}
+	if n >= maxPortForwards {
+		return false
+	}
+	if pfs.starting == nil {
+		pfs.starting = make(map[string]int)
+	}
+	pfs.starting[user]++
+	return true
+}
+
+// release gives back a session that user reserved but never added.
+func (pfs *portForwards) release(user string) {
+	pfs.mu.Lock()
+	defer pfs.mu.Unlock()
+	pfs.starting[user]--
+}
+
+// add starts tracking pf, which takes the place of a reserved session.
+func (pfs *portForwards) add(pf *portForward) {
+	pfs.mu.Lock()
+	defer pfs.mu.Unlock()
+	if pfs.sessions == nil {
+		pfs.sessions = make(map[string]*portForward)
+	}
+	pfs.starting[pf.user]--
+	pfs.next++
+	pf.ID = strconv.Itoa(pfs.next)
+	pfs.sessions[pf.ID] = pf
+}
+
+// list returns user's sessions, oldest first.
+func (pfs *portForwards) list(user string) []*portForward {
+	pfs.mu.Lock()
+	defer pfs.mu.Unlock()
+	sessions := []*portForward{}
+	for _, pf := range pfs.sessions {
+		if pf.user == user {
+			sessions = append(sessions, pf)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+	return sessions
+}
+
+// stop ends user's session id, and reports whether there was one.
+func (pfs *portForwards) stop(user, id string) bool {
+	pfs.mu.Lock()
+	defer pfs.mu.Unlock()
+	pf, ok := pfs.sessions[id]
+	if !ok || pf.user != user {
+		return false
+	}
+	pf.cancel()
+	delete(pfs.sessions, id)
+	return true
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// startTTY isn't supported off linux, so exec sessions fall back to pipes.
+func startTTY(cmd *exec.Cmd) (*os.File, error) {
+	return nil, fmt.Errorf("terminals are only supported on linux")
+}
+
+func resizeTTY(tty *os.File, cols, rows int) error {
+	return nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appc/spec/schema"
+)
+
+// registryPubkeys is the name of the keyring in a registry directory that is
+// advertised via ac-discovery-pubkeys.
+const registryPubkeys = "pubkeys.gpg"
+
+// registryImage is a single .aci file in a registry directory.
+type registryImage struct {
+	file     string
+	modTime  time.Time
+	size     int64
+	manifest json.RawMessage
+	im       *schema.ImageManifest
+}
+
+// registry serves a directory of .aci files, such as the sample/images
+// directory built by sample/make.bash, as an appc discovery endpoint.  Images
+// are found with discovery templates of the form
+// <base>/images/{name}.{ext}?version={version}&os={os}&arch={arch}, and any
+// detached signatures are served from the .aci.asc file next to the image.
+type registry struct {
+	dir string
+
+	mu     sync.Mutex
+	images map[string]*registryImage
+}
+
+// openRegistry indexes every image in dir.
+func openRegistry(dir string) (*registry, error) {
+	if fi, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("unable to open registry: %v", err)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("unable to open registry: %s is not a directory", dir)
+	}
+	r := &registry{
+		dir:    dir,
+		images: make(map[string]*registryImage),
+	}
+	if err := r.refresh(); err != nil {
+		return nil, err
+	}
+	log.Printf("Serving %d images from %s", len(r.images), dir)
+	return r, nil
+}
+
+// refresh rereads the manifest of any image that was added or changed since
+// the last refresh and forgets about any that were removed.
+func (r *registry) refresh() error {
+	files, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return fmt.Errorf("unable to read registry %s: %v", r.dir, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	found := make(map[string]bool)
+	for _, fi := range files {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != ".aci" {
+			continue
+		}
+		found[fi.Name()] = true
+		if img, ok := r.images[fi.Name()]; ok && img.modTime.Equal(fi.ModTime()) && img.size == fi.Size() {
+			continue
+		}
+		img, err := r.readImage(fi)
+		if err != nil {
+			log.Printf("Skipping %s: %v", fi.Name(), err)
+			delete(r.images, fi.Name())
+			continue
+		}
+		r.images[fi.Name()] = img
+	}
+	for name := range r.images {
+		if !found[name] {
+			delete(r.images, name)
+		}
+	}
+	return nil
+}
+
+func (r *registry) readImage(fi os.FileInfo) (*registryImage, error) {
+	f, err := os.Open(filepath.Join(r.dir, fi.Name()))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	manifest, err := readManifest(f)
+	if err != nil {
+		return nil, err
+	}
+	var im schema.ImageManifest
+	if err := json.Unmarshal(manifest, &im); err != nil {
+		return nil, fmt.Errorf("unable to parse manifest: %v", err)
+	}
+	return &registryImage{
+		file:     fi.Name(),
+		modTime:  fi.ModTime(),
+		size:     fi.Size(),
+		manifest: manifest,
+		im:       &im,
+	}, nil
+}
+
+// list returns every image in the registry, sorted by name and then file.
+func (r *registry) list() []*registryImage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var imgs []*registryImage
+	for _, img := range r.images {
+		imgs = append(imgs, img)
+	}
+	sort.Sort(registryImagesByName(imgs))
+	return imgs
+}
+
+type registryImagesByName []*registryImage
+
+func (imgs registryImagesByName) Len() int      { return len(imgs) }
+func (imgs registryImagesByName) Swap(i, j int) { imgs[i], imgs[j] = imgs[j], imgs[i] }
+func (imgs registryImagesByName) Less(i, j int) bool {
+	if imgs[i].im.Name != imgs[j].im.Name {
+		return imgs[i].im.Name < imgs[j].im.Name
+	}
+	return imgs[i].file < imgs[j].file
+}
+
+// find returns the image that matches app, preferring the most recently
+// modified one if there are several.
+func (r *registry) find(app discoveryApp) *registryImage {
+	var best *registryImage
+	for _, img := range r.list() {
+		if matchLabels(app, img.im) != nil {
+			continue
+		}
+		if best == nil || img.modTime.After(best.modTime) {
+			best = img
+		}
+	}
+	return best
+}
+
+// hasName returns true if any image in the registry is named name.  Only
+// those names are answered, a template for a parent name would also claim
+// every image below it that the registry doesn't have.
+func (r *registry) hasName(name string) bool {
+	for _, img := range r.list() {
+		if img.im.Name.String() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP serves discovery documents, images, signatures, the registry's
+// keyring and its catalog.  It expects the registry prefix to have been
+// stripped from the path.
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := r.refresh(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p := strings.TrimPrefix(req.URL.Path, "/")
+	switch {
+	case req.URL.Query().Get("ac-discovery") == "1":
+		r.serveMeta(w, req, p)
+
+	case p == "catalog":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.catalog().entries(req.URL.Query().Get("q")))
+
+	case p == registryPubkeys:
+		http.ServeFile(w, req, filepath.Join(r.dir, registryPubkeys))
+
+	case strings.HasPrefix(p, "images/"):
+		r.serveImage(w, req, strings.TrimPrefix(p, "images/"))
+
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *registry) serveMeta(w http.ResponseWriter, req *http.Request, name string) {
+	if !r.hasName(name) {
+		http.NotFound(w, req)
+		return
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	base := fmt.Sprintf("%s://%s%s", scheme, req.Host, strings.TrimSuffix(registryPrefix, "/"))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n")
+	tmpl := fmt.Sprintf("%s/images/{name}.{ext}?version={version}&os={os}&arch={arch}", base)
+	fmt.Fprintf(w, "<meta name=\"ac-discovery\" content=\"%s %s\">\n", html.EscapeString(name), html.EscapeString(tmpl))
+	if _, err := os.Stat(filepath.Join(r.dir, registryPubkeys)); err == nil {
+		keys := fmt.Sprintf("%s/%s", base, registryPubkeys)
+		fmt.Fprintf(w, "<meta name=\"ac-discovery-pubkeys\" content=\"%s %s\">\n", html.EscapeString(name), html.EscapeString(keys))
+	}
+	fmt.Fprintf(w, "</head>\n</html>\n")
+}
+
+func (r *registry) serveImage(w http.ResponseWriter, req *http.Request, p string) {
+	app := discoveryApp{labels: make(map[string]string)}
+	ext := ".aci"
+	switch {
+	case strings.HasSuffix(p, ".aci.asc"):
+		app.name = strings.TrimSuffix(p, ".aci.asc")
+		ext = ".aci.asc"
+	case strings.HasSuffix(p, ".aci"):
+		app.name = strings.TrimSuffix(p, ".aci")
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	for k, v := range req.URL.Query() {
+		if len(v) > 0 && v[0] != "" {
+			app.labels[k] = v[0]
+		}
+	}
+	img := r.find(app)
+	if img == nil {
+		http.NotFound(w, req)
+		return
+	}
+	path := filepath.Join(r.dir, img.file)
+	if ext == ".aci.asc" {
+		path += ".asc"
+	}
+	log.Printf("Registry serving %s for %s", path, app)
+	http.ServeFile(w, req, path)
+}
+
+// localRegistryHost is the made up host that the server's own registry is
+// reached at.  Requests to it never leave the process, so they don't need to
+// know the address the server listens on or get past its authentication.
+const localRegistryHost = "flow-registry.local"
+
+// localTransport sends requests for localRegistryHost straight to handler and
+// everything else, including everything when there's no handler, to next.
+type localTransport struct {
+	handler http.Handler
+	next    http.RoundTripper
+}
+
+func (t *localTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.handler == nil || req.URL.Host != localRegistryHost {
+		return t.next.RoundTrip(req)
+	}
+	pr, pw := io.Pipe()
+	rw := &pipeResponseWriter{
+		header: make(http.Header),
+		body:   pw,
+		resp:   make(chan *http.Response, 1),
+		req:    req,
+	}
+	go func() {
+		// A panic here would take down the whole server, so it fails just
+		// this request instead.
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("Registry request for %s panicked: %v", req.URL, err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				pw.CloseWithError(fmt.Errorf("registry request for %s failed", req.URL))
+			}
+		}()
+		t.handler.ServeHTTP(rw, req)
+		rw.WriteHeader(http.StatusOK)
+		pw.Close()
+	}()
+	resp := <-rw.resp
+	resp.Body = pr
+	return resp, nil
+}
+
+// pipeResponseWriter streams a response from an http.Handler into a pipe so
+// that large images don't have to be held in memory.
+type pipeResponseWriter struct {
+	header      http.Header
+	body        *io.PipeWriter
+	resp        chan *http.Response
+	req         *http.Request
+	wroteHeader bool
+}
+
+func (rw *pipeResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *pipeResponseWriter) WriteHeader(code int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	rw.resp <- &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rw.header,
+		ContentLength: -1,
+		Request:       rw.req,
+	}
+}
+
+func (rw *pipeResponseWriter) Write(data []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	return rw.body.Write(data)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+const testManifest = `{"acKind":"ImageManifest","acVersion":"0.7.4","name":"example.com/app",` +
+	`"labels":[{"name":"version","value":"1.0"},{"name":"os","value":"linux"},{"name":"arch","value":"amd64"}],` +
+	`"app":{"exec":["/bin/app"],"user":"0","group":"0","ports":[{"name":"http","port":80,"protocol":"tcp"}]}}`
+
+// testACI returns a gzipped ACI holding nothing but manifest and an empty
+// rootfs.
+func testACI(t *testing.T, manifest string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: "rootfs/", Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest", Mode: 0644, Size: int64(len(manifest))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(manifest)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// failingTransport fails every request, it stands in for the network so that
+// tests never reach an image's real domain.
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, errors.New("not reachable in tests")
+}
+
+// testRegistryServer returns a server whose only reachable source of images is
+// a registry in a temporary directory holding app.aci, signed by a new key that
+// is published as the registry's keyring.
+func testRegistryServer(t *testing.T, trustDiscovered bool) (*server, *openpgp.Entity, func()) {
+	dir, err := ioutil.TempDir("", "flow-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	aci := testACI(t, testManifest)
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.aci"), aci, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := openpgp.NewEntity("Test Signer", "", "signer@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var asc bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&asc, signer, bytes.NewReader(aci), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.aci.asc"), asc.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var pubkeys bytes.Buffer
+	w, err := armor.Encode(&pubkeys, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, registryPubkeys), pubkeys.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := openRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := openImageCache(filepath.Join(dir, "cache"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &localTransport{
+		handler: http.StripPrefix(strings.TrimSuffix(registryPrefix, "/"), reg),
+		next:    failingTransport{},
+	}}
+	s := &server{
+		auth: noAuth{},
+		discovery: &discoverer{
+			client:     client,
+			registries: []string{"http://" + localRegistryHost + strings.TrimSuffix(registryPrefix, "/")},
+		},
+		verifier: &verifier{
+			client:          client,
+			trustDiscovered: trustDiscovered,
+			results:         make(map[string]*signatureInfo),
+		},
+		cache:        cache,
+		registry:     reg,
+		maxImageSize: 1 << 20,
+	}
+	return s, signer, cleanup
+}
+
+func getContainer(t *testing.T, s *server, name string) containerInfo {
+	w := httptest.NewRecorder()
+	if err := s.handleContainer(w, httptest.NewRequest("GET", "/container/"+name, nil)); err != nil {
+		t.Fatalf("handleContainer(%s): %v", name, err)
+	}
+	var info containerInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatalf("unable to decode the container info for %s: %v", name, err)
+	}
+	return info
+}
+
+// settledContainer asks for name until the server has finished downloading its
+// image, and so has checked its signature.
+func settledContainer(t *testing.T, s *server, name string) containerInfo {
+	for i := 0; i < 100; i++ {
+		info := getContainer(t, s, name)
+		if info.Signature.Status != signaturePending {
+			return info
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s is still downloading", name)
+	return containerInfo{}
+}
+
+func TestRegistryServesSignedImage(t *testing.T) {
+	s, signer, cleanup := testRegistryServer(t, false)
+	defer cleanup()
+	s.verifier.trusted = openpgp.EntityList{signer}
+
+	info := settledContainer(t, s, "example.com/app?version=1.0")
+	var manifest struct{ Name string }
+	if err := json.Unmarshal(info.Manifest, &manifest); err != nil || manifest.Name != "example.com/app" {
+		t.Errorf("manifest = %s, want example.com/app's", info.Manifest)
+	}
+	if info.Signature.Status != signatureVerified {
+		t.Errorf("signature = %+v, want it verified", info.Signature)
+	}
+	if info.Image != "example.com/app:1.0" {
+		t.Errorf("image = %q, want example.com/app:1.0", info.Image)
+	}
+}
+
+func TestRegistryTrustsDiscoveredKeys(t *testing.T) {
+	s, _, cleanup := testRegistryServer(t, false)
+	defer cleanup()
+	if info := settledContainer(t, s, "example.com/app"); info.Signature.Status != signatureUntrusted {
+		t.Errorf("signature without trusted keys = %+v, want it untrusted", info.Signature)
+	}
+
+	s, _, cleanup = testRegistryServer(t, true)
+	defer cleanup()
+	if info := settledContainer(t, s, "example.com/app"); info.Signature.Status != signatureVerified {
+		t.Errorf("signature with the registry's keys trusted = %+v, want it verified", info.Signature)
+	}
+}
+
+func TestRegistryUnknownImage(t *testing.T) {
+	s, _, cleanup := testRegistryServer(t, false)
+	defer cleanup()
+	w := httptest.NewRecorder()
+	if err := s.handleContainer(w, httptest.NewRequest("GET", "/container/example.com/missing", nil)); err == nil {
+		t.Errorf("handleContainer succeeded for an image that isn't in the registry")
+	}
+	for _, name := range []string{"example.com", "example.com/missing"} {
+		w := httptest.NewRecorder()
+		s.registry.ServeHTTP(w, httptest.NewRequest("GET", "/"+name+"?ac-discovery=1", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("registry answered discovery for %s with %d, want %d", name, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestRegistryFallsBackToImageDomain(t *testing.T) {
+	remote := httptest.NewTLSServer(nil)
+	defer remote.Close()
+	host := strings.TrimPrefix(remote.URL, "https://")
+	sibling := testACI(t, strings.Replace(testManifest, "example.com/app", host+"/sibling", 1))
+	remote.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Query().Get("ac-discovery") == "1" && r.URL.Path == "/sibling":
+			fmt.Fprint(w, metaTag("ac-discovery", host+"/sibling", "https://"+host+"/images/{name}.{ext}"))
+		case r.URL.Path == "/images/"+host+"/sibling.aci":
+			w.Write(sibling)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	s, _, cleanup := testRegistryServer(t, false)
+	defer cleanup()
+	s.discovery.client.Transport.(*localTransport).next = remote.Client().Transport
+	local := testACI(t, strings.Replace(testManifest, "example.com/app", host+"/local", 1))
+	if err := ioutil.WriteFile(filepath.Join(s.registry.dir, "local.aci"), local, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{host + "/local", host + "/sibling"} {
+		info := getContainer(t, s, name)
+		var manifest struct{ Name string }
+		if err := json.Unmarshal(info.Manifest, &manifest); err != nil || manifest.Name != name {
+			t.Errorf("manifest = %s, want %s's", info.Manifest, name)
+		}
+	}
+}
+
+func TestLocalTransportWithoutRegistry(t *testing.T) {
+	client := &http.Client{Transport: &localTransport{next: failingTransport{}}}
+	d := &discoverer{client: client, registries: []string{"http://" + localRegistryHost + "/registry"}}
+	if _, err := d.discover(discoveryApp{name: "example.com/app"}); err == nil {
+		t.Errorf("discover succeeded without a registry")
+	}
+}
+
+func TestImageShownBeforeDownloadFinishes(t *testing.T) {
+	aci := testACI(t, strings.Replace(testManifest, "example.com/app", "example.com/big", 1))
+	release := make(chan struct{})
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Query().Get("ac-discovery") == "1" && r.URL.Path == "/example.com/big":
+			fmt.Fprint(w, metaTag("ac-discovery", "example.com/big", ts.URL+"/images/{name}.{ext}"))
+		case r.URL.Path == "/images/example.com/big.aci":
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			// Hold back the end of the response, the manifest is all
+			// that's needed to show the image.
+			w.Write(aci)
+			w.(http.Flusher).Flush()
+			<-release
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	var once sync.Once
+	finish := func() { once.Do(func() { close(release) }) }
+	defer finish()
+
+	s, _, cleanup := testRegistryServer(t, false)
+	defer cleanup()
+	s.discovery.client.Transport.(*localTransport).next = http.DefaultTransport
+	s.discovery.registries = []string{ts.URL}
+
+	info := getContainer(t, s, "example.com/big")
+	var manifest struct{ Name string }
+	if err := json.Unmarshal(info.Manifest, &manifest); err != nil || manifest.Name != "example.com/big" {
+		t.Errorf("manifest = %s, want example.com/big's", info.Manifest)
+	}
+	if info.Signature.Status != signaturePending {
+		t.Errorf("signature = %+v while the image is downloading, want it pending", info.Signature)
+	}
+
+	finish()
+	if info := settledContainer(t, s, "example.com/big"); info.Signature.Status != signatureUnsigned {
+		t.Errorf("signature = %+v once the image has downloaded, want it unsigned", info.Signature)
+	}
+}
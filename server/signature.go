@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// signatureStatus describes whether an image's signature could be verified.
+type signatureStatus string
+
+const (
+	signatureVerified  signatureStatus = "verified"
+	signatureUnsigned  signatureStatus = "unsigned"
+	signatureUntrusted signatureStatus = "untrusted"
+
+	// signaturePending is the status of an image that's still downloading,
+	// since only the whole image can be checked.
+	signaturePending signatureStatus = "pending"
+)
+
+// maxSignatureSize is the largest detached signature that will be downloaded.
+const maxSignatureSize = 1 << 20
+
+// maxKeyRingSize is the largest discovered keyring that will be downloaded.
+const maxKeyRingSize = 1 << 20
+
+// signatureInfo is the result of verifying an image, it is sent to the
+// frontend along with the image's manifest.
+type signatureInfo struct {
+	Status  signatureStatus `json:"status"`
+	Signer  string          `json:"signer,omitempty"`
+	Message string          `json:"message,omitempty"`
+}
+
+// verifier checks detached image signatures against a set of trusted keys.
+type verifier struct {
+	client  *http.Client
+	trusted openpgp.EntityList
+
+	// If trustDiscovered is set then keys found via ac-discovery-pubkeys are
+	// trusted in addition to those in trusted.
+	trustDiscovered bool
+
+	mu      sync.Mutex
+	results map[string]*signatureInfo
+}
+
+// loadTrustedKeys reads every armored or binary keyring in dir.  A missing
+// directory is not an error, it just means nothing is trusted.
+func loadTrustedKeys(dir string) (openpgp.EntityList, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read trusted keys from %s: %v", dir, err)
+	}
+	var keys openpgp.EntityList
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read trusted key %s: %v", path, err)
+		}
+		el, err := readKeyRing(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse trusted key %s: %v", path, err)
+		}
+		log.Printf("Trusting %d keys from %s", len(el), path)
+		keys = append(keys, el...)
+	}
+	return keys, nil
+}
+
+// readKeyRing parses data as an armored keyring, falling back to a binary one.
+func readKeyRing(data []byte) (openpgp.EntityList, error) {
+	if el, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data)); err == nil {
+		return el, nil
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+// fetchSignature downloads the detached signature at url.  A missing signature
+// is not an error, it just returns nil.
+func (v *verifier) fetchSignature(url string) ([]byte, error) {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch signature: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch signature from %s: %s", url, resp.Status)
+	}
+	asc, err := ioutil.ReadAll(&limitedReader{r: resp.Body, limit: maxSignatureSize})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read signature: %v", err)
+	}
+	return asc, nil
+}
+
+// verify checks aci against the detached signature asc.  An untrusted signer
+// isn't an error, that is reported in the returned signatureInfo so that the
+// caller can decide what to do with it.
+func (v *verifier) verify(aci io.Reader, asc []byte, pubkeys []string) *signatureInfo {
+	// keys is a copy so that discovered keys never end up in v.trusted, which
+	// every verification shares.
+	keys := append(openpgp.EntityList(nil), v.trusted...)
+	if v.trustDiscovered {
+		for _, u := range pubkeys {
+			el, err := v.fetchKeys(u)
+			if err != nil {
+				log.Printf("Ignoring discovered keys at %s: %v", u, err)
+				continue
+			}
+			keys = append(keys, el...)
+		}
+	}
+	if len(keys) == 0 {
+		return &signatureInfo{Status: signatureUntrusted, Message: "no trusted keys are configured"}
+	}
+	signer, err := openpgp.CheckArmoredDetachedSignature(keys, aci, bytes.NewReader(asc))
+	if err != nil {
+		return &signatureInfo{Status: signatureUntrusted, Message: err.Error()}
+	}
+	info := &signatureInfo{Status: signatureVerified}
+	for name := range signer.Identities {
+		info.Signer = name
+		break
+	}
+	return info
+}
+
+// verifyApp verifies the cached image and signature of entry.  Results are
+// remembered for as long as the server runs since the trusted keys can't
+// change underneath it.
+func (s *server) verifyApp(entry *cachedApp) (*signatureInfo, error) {
+	if entry.download != nil {
+		return &signatureInfo{Status: signaturePending, Message: fmt.Sprintf("%s is still downloading", entry.URL)}, nil
+	}
+	if entry.SignatureID == "" {
+		return &signatureInfo{Status: signatureUnsigned, Message: fmt.Sprintf("no signature for %s", entry.URL)}, nil
+	}
+	key := entry.ImageID + "/" + entry.SignatureID
+	s.verifier.mu.Lock()
+	info, ok := s.verifier.results[key]
+	s.verifier.mu.Unlock()
+	if ok {
+		return info, nil
+	}
+
+	asc, err := s.cache.readAll(entry.SignatureID)
+	if err != nil {
+		return &signatureInfo{Status: signatureUnsigned, Message: fmt.Sprintf("signature for %s is no longer cached", entry.URL)}, nil
+	}
+	aci, err := s.cache.open(entry.ImageID)
+	if err != nil {
+		return nil, err
+	}
+	defer aci.Close()
+	info = s.verifier.verify(aci, asc, entry.Pubkeys)
+
+	s.verifier.mu.Lock()
+	s.verifier.results[key] = info
+	s.verifier.mu.Unlock()
+	return info, nil
+}
+
+func (v *verifier) fetchKeys(u string) (openpgp.EntityList, error) {
+	resp, err := v.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(&limitedReader{r: resp.Body, limit: maxKeyRingSize})
+	if err != nil {
+		return nil, err
+	}
+	return readKeyRing(data)
+}
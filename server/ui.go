@@ -0,0 +1,33 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+)
+
+//go:generate gopherjs build -m -o _html/frontend.js github.com/runningwild/flow/frontend
+//go:generate cp ../frontend/index.html _html/index.html
+
+// assets is the UI as it was when the server was built.
+//
+//go:embed _html
+var assets embed.FS
+
+// uiFiles returns the UI's files.  They're read from dir if it's set, which is
+// handy while working on the frontend, and are otherwise the ones built into
+// the binary.
+func uiFiles(dir string) (http.FileSystem, error) {
+	if dir != "" {
+		return http.Dir(dir), nil
+	}
+	ui, err := fs.Sub(assets, "_html")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fs.Stat(ui, "frontend.js"); err != nil {
+		return nil, fmt.Errorf("the UI wasn't built into this binary, run go generate before building it or serve it with --static-dir")
+	}
+	return http.FS(ui), nil
+}